@@ -1,17 +1,106 @@
+//go:build ignore
+
 package main
 
 import (
+	"encoding/json"
 	"fmt"
-	//"io/ioutil"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"sync"
 	"time"
 )
 
+type Configuration struct {
+	ServicePort int		`json:"servicePort"`
+	Replicas	[]string`json:"replicas"`
+}
+
+// nodeHealth is what the load balancer learned from a node's last heartbeat
+type nodeHealth struct {
+	alive     bool
+	isPrimary bool
+	term      uint64
+}
+
+var (
+	health   = make(map[string]*nodeHealth)
+	healthMu sync.Mutex
+)
+
+// checkHealth polls every node's heartbeat so that dead nodes are skipped and writes reach the current primary
+func checkHealth(targetUrls []*url.URL) {
+	client := http.Client{Timeout: 500 * time.Millisecond}
+
+	for {
+		for _, targetUrl := range targetUrls {
+			var hb struct {
+				IsPrimary bool   `json:"isPrimary"`
+				Term      uint64 `json:"term"`
+			}
+
+			alive := false
+			resp, err := client.Get(targetUrl.String() + "/cluster/heartbeat")
+			if err == nil {
+				alive = resp.StatusCode == http.StatusOK && json.NewDecoder(resp.Body).Decode(&hb) == nil
+				resp.Body.Close()
+			}
+
+			healthMu.Lock()
+			h, ok := health[targetUrl.Host]
+			if !ok {
+				h = &nodeHealth{alive: true}
+				health[targetUrl.Host] = h
+			}
+			if h.alive != alive {
+				fmt.Printf("[2023 %s] Load Balancer [HEALTH] [%s] alive: %t\n", time.Now().Format(time.StampNano), targetUrl.Host, alive)
+			}
+			if alive && hb.IsPrimary && !h.isPrimary {
+				fmt.Printf("[2023 %s] Load Balancer [HEALTH] [%s] is primary for term %d\n", time.Now().Format(time.StampNano), targetUrl.Host, hb.Term)
+			}
+			h.alive = alive
+			h.isPrimary = alive && hb.IsPrimary
+			h.term = hb.Term
+			healthMu.Unlock()
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+// pickTarget returns the primary for writes, and the next live node in round-robin order for reads
+func pickTarget(r *http.Request, targetUrls []*url.URL, nextIndex int) int {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+
+	if r.Method != http.MethodGet {
+		primary, primaryTerm := -1, uint64(0)
+		for i, targetUrl := range targetUrls {
+			if h, ok := health[targetUrl.Host]; ok && h.isPrimary && (primary < 0 || h.term > primaryTerm) {
+				primary, primaryTerm = i, h.term
+			}
+		}
+		if primary >= 0 {
+			return primary
+		}
+	}
+
+	for i := 0; i < len(targetUrls); i++ {
+		index := (nextIndex + i) % len(targetUrls)
+		if h, ok := health[targetUrls[index].Host]; !ok || h.alive {
+			return index
+		}
+	}
+	return nextIndex
+}
+
 func loadBalancerHandler(targetUrls []*url.URL) func(http.ResponseWriter, *http.Request) {
 	nextIndex := 0
+	var mu sync.Mutex
 	proxyServers := make([]*httputil.ReverseProxy, len(targetUrls))
 
 	for i, targetUrl := range targetUrls {
@@ -19,12 +108,16 @@ func loadBalancerHandler(targetUrls []*url.URL) func(http.ResponseWriter, *http.
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		fmt.Printf("[2023 %s] Load Balancer [FORWARD REQUEST] [METHOD: %s] to [%s]\n", time.Now().Format(time.StampNano), r.Method, targetUrls[nextIndex])
+		mu.Lock()
+		index := pickTarget(r, targetUrls, nextIndex)
+		nextIndex = (index + 1) % len(targetUrls)
+		mu.Unlock()
+
+		fmt.Printf("[2023 %s] Load Balancer [FORWARD REQUEST] [METHOD: %s] to [%s]\n", time.Now().Format(time.StampNano), r.Method, targetUrls[index])
 
-		proxyServers[nextIndex].ServeHTTP(w, r)
-		nextIndex = (nextIndex + 1) % len(targetUrls)
+		proxyServers[index].ServeHTTP(w, r)
 
-		fmt.Printf("[2023 %s] Load Balancer [FORWARD REPLY]   [METHOD: %s] from [%s]\n", time.Now().Format(time.StampNano), r.Method, targetUrls[nextIndex])
+		fmt.Printf("[2023 %s] Load Balancer [FORWARD REPLY]   [METHOD: %s] from [%s]\n", time.Now().Format(time.StampNano), r.Method, targetUrls[index])
 	}
 }
 
@@ -39,14 +132,38 @@ func main() {
 			Host:   "localhost:8081",
 		},
 	}
+	servicePort := 5000
+
+	// with a config.json every node listed in it is balanced, not only the default two
+	if len(os.Args) == 2 {
+		configData, err := ioutil.ReadFile(os.Args[1])
+		if err != nil {
+			log.Fatalf("Error reading the config file: %s\n", err)
+		}
+
+		var config Configuration
+		err = json.Unmarshal(configData, &config)
+		if err != nil {
+			log.Fatalf("Error decoding the config JSON: %s\n", err)
+		}
+
+		clientUrls = nil
+		for _, replica := range config.Replicas {
+			clientUrls = append(clientUrls, &url.URL{Scheme: "http", Host: replica})
+		}
+		if config.ServicePort != 0 {
+			servicePort = config.ServicePort
+		}
+	}
+
+	go checkHealth(clientUrls)
 
 	handler := loadBalancerHandler(clientUrls)
 
 	http.HandleFunc("/", handler)
 
-	fmt.Println("Load Balancer Server is running on port 5000...")
-	if err := http.ListenAndServe(":5000", nil); err != nil {
+	fmt.Printf("Load Balancer Server is running on port %d...\n", servicePort)
+	if err := http.ListenAndServe(fmt.Sprintf(":%d", servicePort), nil); err != nil {
 		log.Fatal(err)
 	}
 }
-
@@ -0,0 +1,338 @@
+package node
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+	Anti-entropy
+
+	Lost updates and diverged IDs go unnoticed by the log, so every replica periodically compares its memos
+	with the primary's. Both sides hash their memos into a Merkle tree over ID ranges: a leaf covers
+	merkleLeafSize IDs and every inner node hashes its two halves. The replica walks down only the subtrees
+	whose hashes differ and replaces the memos of each differing leaf with the primary's. A range without
+	memos hashes to the empty string without being split, so the work grows with the memos and not with the
+	width of the range a peer asks for, and it happens on a copy taken outside memosMu. A round only runs
+	when the replica applied the same sequence number as the primary, so that entries still in flight are
+	not mistaken for divergence. Writes go on during the round, so a leaf is only repaired when both sides
+	described it at the same sequence number, and a memo that changed here since the diff is left alone.
+*/
+
+const merkleLeafSize = 16
+
+// merkleNode is what a node reports about one ID range
+type merkleNode struct {
+	MaxID    int      `json:"maxId"`
+	Seq      uint64   `json:"seq"` // last sequence number applied when the range was described
+	Hash     string   `json:"hash,omitempty"`
+	Children []string `json:"children,omitempty"` // hashes of the two halves of an inner range
+	Memos    []Memo   `json:"memos,omitempty"`    // contents of a leaf range
+}
+
+type antiEntropyStats struct {
+	Rounds            uint64    `json:"rounds"`
+	RoundsWithRepairs uint64    `json:"roundsWithRepairs"`
+	RangesCompared    uint64    `json:"rangesCompared"`
+	LeavesDiffering   uint64    `json:"leavesDiffering"`
+	MemosRepaired     uint64    `json:"memosRepaired"`
+	MemosRemoved      uint64    `json:"memosRemoved"`
+	RepairsSkipped    uint64    `json:"repairsSkipped"` // memos or leaves that changed while they were compared
+	LastRound         time.Time `json:"lastRound"`
+	LastError         string    `json:"lastError,omitempty"`
+}
+
+var (
+	aeMu    sync.Mutex
+	aeStats antiEntropyStats
+)
+
+func antiEntropyInterval() time.Duration {
+	if Config.AntiEntropyIntervalMs <= 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(Config.AntiEntropyIntervalMs) * time.Millisecond
+}
+
+// sortedMemos returns copies of the memos with lo <= ID < hi ordered by ID, must be called with memosMu held
+func sortedMemos(lo, hi int) []Memo {
+	return memosIn(AllMemos(), lo, hi)
+}
+
+// memosIn clamps the range lo <= ID < hi to the IDs that exist in memos, which are ordered by ID
+func memosIn(memos []Memo, lo, hi int) []Memo {
+	from := sort.Search(len(memos), func(i int) bool {
+		return memos[i].ID >= lo
+	})
+	to := sort.Search(len(memos), func(i int) bool {
+		return memos[i].ID >= hi
+	})
+	if from >= to {
+		return nil
+	}
+	return memos[from:to]
+}
+
+// merkleHash hashes the range lo <= ID < hi, sorted holds exactly the memos of that range
+func merkleHash(sorted []Memo, lo, hi int) string {
+	if len(sorted) == 0 {
+		return ""
+	}
+	h := sha256.New()
+	if hi-lo <= merkleLeafSize {
+		for _, memo := range sorted {
+			data, _ := json.Marshal(memo)
+			h.Write(data)
+		}
+	} else {
+		mid := lo + (hi-lo)/2
+		split := sort.Search(len(sorted), func(i int) bool {
+			return sorted[i].ID >= mid
+		})
+		h.Write([]byte(merkleHash(sorted[:split], lo, mid)))
+		h.Write([]byte(merkleHash(sorted[split:], mid, hi)))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// localMerkle describes one range of our own tree, the memos are copied under memosMu and hashed outside it
+func localMerkle(lo, hi int) merkleNode {
+	MemosMu.Lock()
+	node := merkleNode{Seq: LastSeq}
+	memos := AllMemos()
+	MemosMu.Unlock()
+
+	if len(memos) > 0 {
+		node.MaxID = memos[len(memos)-1].ID
+	}
+	if hi <= lo {
+		return node
+	}
+
+	sorted := memosIn(memos, lo, hi)
+	node.Hash = merkleHash(sorted, lo, hi)
+	if hi-lo <= merkleLeafSize {
+		node.Memos = sorted
+	} else {
+		mid := lo + (hi-lo)/2
+		split := sort.Search(len(sorted), func(i int) bool {
+			return sorted[i].ID >= mid
+		})
+		node.Children = []string{merkleHash(sorted[:split], lo, mid), merkleHash(sorted[split:], mid, hi)}
+	}
+	return node
+}
+
+// handleMerkle serves GET /antientropy/tree?lo=&hi=, without a range only maxId is returned
+func handleMerkle(w http.ResponseWriter, r *http.Request) {
+	lo, _ := strconv.Atoi(r.URL.Query().Get("lo"))
+	hi, _ := strconv.Atoi(r.URL.Query().Get("hi"))
+	if lo < 1 {
+		// IDs start at 1, and hi-lo must not overflow
+		lo = 1
+	}
+
+	node := localMerkle(lo, hi)
+
+	response, err := json.Marshal(node)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(response)
+}
+
+func fetchMerkle(addr string, lo, hi int) (merkleNode, error) {
+	var node merkleNode
+	client := http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get(fmt.Sprintf("http://%s/antientropy/tree?lo=%d&hi=%d", addr, lo, hi))
+	if err != nil {
+		return node, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return node, fmt.Errorf("merkle request failed: %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&node)
+	return node, err
+}
+
+// compareRange walks down the subtrees that differ from the primary's and repairs the differing leaves
+func compareRange(primary string, lo, hi int, round *antiEntropyStats) error {
+	remote, err := fetchMerkle(primary, lo, hi)
+	if err != nil {
+		return err
+	}
+	local := localMerkle(lo, hi)
+
+	round.RangesCompared++
+	if remote.Hash == local.Hash {
+		return nil
+	}
+
+	if hi-lo <= merkleLeafSize {
+		round.LeavesDiffering++
+		repairRange(lo, hi, remote, local, round)
+		return nil
+	}
+
+	mid := lo + (hi-lo)/2
+	if len(remote.Children) != 2 || remote.Children[0] != local.Children[0] {
+		err = compareRange(primary, lo, mid, round)
+		if err != nil {
+			return err
+		}
+	}
+	if len(remote.Children) != 2 || remote.Children[1] != local.Children[1] {
+		return compareRange(primary, mid, hi, round)
+	}
+	return nil
+}
+
+// repairRange makes the memos of the leaf equal to the primary's, remote and local describe the leaf as the
+// primary and this node saw it when they were compared
+func repairRange(lo, hi int, remote merkleNode, local merkleNode, round *antiEntropyStats) {
+	MemosMu.Lock()
+	defer MemosMu.Unlock()
+
+	if remote.Seq != local.Seq {
+		// the two sides were described at different points of the log, the difference may be in flight
+		round.RepairsSkipped++
+		return
+	}
+	compared := make(map[int]Memo)
+	for _, memo := range local.Memos {
+		compared[memo.ID] = memo
+	}
+	unchanged := func(id int) bool {
+		current, ok := GetMemo(id)
+		before, was := compared[id]
+		if ok != was || (ok && !sameMemo(current, before)) {
+			round.RepairsSkipped++
+			return false
+		}
+		return true
+	}
+
+	keep := make(map[int]bool)
+	for _, memo := range remote.Memos {
+		keep[memo.ID] = true
+		if current, ok := GetMemo(memo.ID); ok && sameMemo(current, memo) {
+			continue
+		}
+		if !unchanged(memo.ID) {
+			continue
+		}
+		upsertMemo(memo)
+		if memo.ID > IDCount {
+			IDCount = memo.ID
+		}
+		if crdtEnabled() {
+			go crdtResync(memo.ID, "")
+		}
+		round.MemosRepaired++
+		fmt.Printf("[2023 %s] %s SERVER [ANTI-ENTROPY]   memo %d repaired from the primary\n", time.Now().Format(time.StampNano), Role, memo.ID)
+	}
+	for _, memo := range sortedMemos(lo, hi) {
+		if !keep[memo.ID] && unchanged(memo.ID) {
+			removeMemo(memo.ID)
+			delete(crdtDocs, memo.ID)
+			round.MemosRemoved++
+			fmt.Printf("[2023 %s] %s SERVER [ANTI-ENTROPY]   memo %d removed, the primary does not have it\n", time.Now().Format(time.StampNano), Role, memo.ID)
+		}
+	}
+}
+
+// antiEntropyRound compares the whole tree with the primary's
+func antiEntropyRound(primary string) {
+	var round antiEntropyStats
+	root, err := fetchMerkle(primary, 0, 0)
+	if err == nil {
+		maxID := localMerkle(0, 0).MaxID
+		if root.MaxID > maxID {
+			maxID = root.MaxID
+		}
+
+		span := merkleLeafSize
+		for span < maxID {
+			span *= 2
+		}
+		err = compareRange(primary, 1, 1+span, &round)
+	}
+
+	aeMu.Lock()
+	aeStats.Rounds++
+	aeStats.RangesCompared += round.RangesCompared
+	aeStats.LeavesDiffering += round.LeavesDiffering
+	aeStats.MemosRepaired += round.MemosRepaired
+	aeStats.MemosRemoved += round.MemosRemoved
+	aeStats.RepairsSkipped += round.RepairsSkipped
+	if round.MemosRepaired+round.MemosRemoved > 0 {
+		aeStats.RoundsWithRepairs++
+	}
+	aeStats.LastRound = time.Now()
+	aeStats.LastError = ""
+	if err != nil {
+		aeStats.LastError = err.Error()
+	}
+	aeMu.Unlock()
+
+	if err != nil {
+		log.Printf("Anti-entropy with %s failed: %s\n", primary, err)
+	} else if round.LeavesDiffering > 0 {
+		fmt.Printf("[2023 %s] %s SERVER [ANTI-ENTROPY]   %d ranges compared, %d leaves differed, %d memos repaired, %d removed\n", time.Now().Format(time.StampNano), Role, round.RangesCompared, round.LeavesDiffering, round.MemosRepaired, round.MemosRemoved)
+	}
+}
+
+// runAntiEntropy compares with the primary every antiEntropyIntervalMs while this node is a caught-up replica
+func runAntiEntropy() {
+	for {
+		time.Sleep(antiEntropyInterval())
+
+		clusterMu.Lock()
+		primary := CurrentPrimary
+		p, seen := peers[primary]
+		primarySeq := uint64(0)
+		if seen {
+			primarySeq = p.hb.LastSeq
+		}
+		selfPrimary := isPrimary
+		clusterMu.Unlock()
+
+		MemosMu.Lock()
+		applied := LastSeq
+		isReady := Ready
+		MemosMu.Unlock()
+
+		if selfPrimary || primary == "" || !seen || !isReady || primarySeq != applied {
+			continue
+		}
+		antiEntropyRound(primary)
+	}
+}
+
+// antiEntropyStatus serves GET /admin/antientropy with the repair counters
+func antiEntropyStatus(w http.ResponseWriter, r *http.Request) {
+	aeMu.Lock()
+	response, err := json.Marshal(aeStats)
+	aeMu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(response)
+}
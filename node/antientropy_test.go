@@ -0,0 +1,70 @@
+package node
+
+import "testing"
+
+// TestRepairSkipsChangedMemos checks that a repair leaves alone memos that changed after the comparison and
+// leaves that the primary described at another sequence number
+func TestRepairSkipsChangedMemos(t *testing.T) {
+	Config = Configuration{Replicas: []string{"127.0.0.1:1"}}
+	SelfAddr = Config.Replicas[0]
+	MemoStore = &memoryStore{}
+	LastSeq = 5
+
+	MemosMu.Lock()
+	upsertMemo(Memo{ID: 1, Title: "diverged", Version: 1})
+	upsertMemo(Memo{ID: 2, Title: "diverged", Version: 1})
+	upsertMemo(Memo{ID: 3, Title: "extra", Version: 1})
+	MemosMu.Unlock()
+	local := localMerkle(1, 1+merkleLeafSize)
+
+	remote := merkleNode{Seq: 5, Memos: []Memo{{ID: 1, Title: "one", Version: 1}, {ID: 2, Title: "two", Version: 1}}}
+
+	var round antiEntropyStats
+	stale := remote
+	stale.Seq = 6
+	repairRange(1, 1+merkleLeafSize, stale, local, &round)
+	if round.RepairsSkipped != 1 || round.MemosRepaired != 0 || round.MemosRemoved != 0 {
+		t.Fatalf("repair against a tree at another seq: %+v", round)
+	}
+
+	// memo 2 is written after the comparison, the repair must not undo that write
+	MemosMu.Lock()
+	upsertMemo(Memo{ID: 2, Title: "newer", Version: 2})
+	MemosMu.Unlock()
+
+	round = antiEntropyStats{}
+	repairRange(1, 1+merkleLeafSize, remote, local, &round)
+	if round.MemosRepaired != 1 || round.MemosRemoved != 1 || round.RepairsSkipped != 1 {
+		t.Fatalf("repair counted %+v, expected one repaired, one removed and one skipped", round)
+	}
+
+	MemosMu.Lock()
+	defer MemosMu.Unlock()
+	want := []Memo{{ID: 1, Title: "one", Version: 1}, {ID: 2, Title: "newer", Version: 2}}
+	got := AllMemos()
+	if len(got) != len(want) || !sameMemo(got[0], want[0]) || !sameMemo(got[1], want[1]) {
+		t.Fatalf("memos after the repair %+v, expected %+v", got, want)
+	}
+}
+
+// TestMerkleWideRange checks that the work for a range depends on the memos in it and not on its width
+func TestMerkleWideRange(t *testing.T) {
+	Config = Configuration{Replicas: []string{"127.0.0.1:1"}}
+	SelfAddr = Config.Replicas[0]
+	MemoStore = &memoryStore{}
+	LastSeq = 2
+
+	MemosMu.Lock()
+	upsertMemo(Memo{ID: 1, Title: "one", Version: 1})
+	upsertMemo(Memo{ID: 3, Title: "three", Version: 1})
+	MemosMu.Unlock()
+
+	// a range this wide could never be walked subrange by subrange
+	wide := localMerkle(1, 1+merkleLeafSize<<50)
+	if wide.Hash == "" || wide.MaxID != 3 || len(wide.Children) != 2 || wide.Children[1] != "" {
+		t.Fatalf("wide range described as %+v", wide)
+	}
+	if empty := localMerkle(4, 1+merkleLeafSize<<50); empty.Hash != "" {
+		t.Fatalf("range without memos hashed to %q", empty.Hash)
+	}
+}
@@ -0,0 +1,569 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Atomic mode ("sync": "atomic")
+
+	Writes use two-phase commit. The primary builds the log entry without applying it and asks every
+	replica to prepare it. Only when all of them vote yes is the entry committed everywhere, the primary
+	included, otherwise every node aborts it and nothing changes. The primary records each step in its
+	transaction log file before acting on it. After a crash it aborts transactions that never reached a
+	decision, applies the commits it may have crashed before applying and delivers the decisions it already
+	made. A replica whose transaction stays prepared for
+	longer than failoverTimeoutMs asks the coordinator for the outcome, and then the other replicas.
+*/
+
+// txRecord is one line of the transaction log, and the state a node keeps per transaction
+type txRecord struct {
+	Tx          string   `json:"tx"`
+	Coordinator string   `json:"coordinator"`
+	State       string   `json:"state"` // prepared, committed, aborted or done
+	Entry       LogEntry `json:"entry"`
+}
+
+// txVote is one replica's answer to a prepare request
+type txVote struct {
+	URL    string `json:"replica"`
+	Yes    bool   `json:"yes"`
+	Reason string `json:"reason,omitempty"`
+}
+
+var (
+	txMu       sync.Mutex
+	coordMu    sync.Mutex // one transaction at a time as coordinator, held across its network calls
+	txLogFile  *os.File
+	txStates   = make(map[string]txRecord) // transaction -> latest state, as coordinator or participant
+	preparedTx *txRecord                   // the one transaction this node has prepared and not yet finished
+	preparedAt time.Time
+)
+
+func txLogPath() string {
+	if Config.TxLog != "" {
+		return Config.TxLog
+	}
+	return "2pc-" + strings.Replace(SelfAddr, ":", "_", -1) + ".log"
+}
+
+// writeTxLog records a coordinator step durably before it takes effect
+func writeTxLog(rec txRecord) error {
+	txMu.Lock()
+	defer txMu.Unlock()
+
+	if rec.State != "done" {
+		txStates[rec.Tx] = rec
+	}
+	if txLogFile == nil {
+		f, err := os.OpenFile(txLogPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		txLogFile = f
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = txLogFile.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	return txLogFile.Sync()
+}
+
+// txCall sends one 2PC message to a node
+func txCall(addr string, path string, rec txRecord) (*http.Response, error) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, "http://"+addr+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	SetEpochHeaders(req)
+
+	client := http.Client{Timeout: 2 * time.Second}
+	return client.Do(req)
+}
+
+func otherNodes() []string {
+	var addrs []string
+	for _, addr := range Config.Replicas {
+		if addr != SelfAddr {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// prepareAll asks every other node to prepare the transaction and collects the votes
+func prepareAll(rec txRecord) ([]txVote, bool) {
+	addrs := otherNodes()
+	votes := make([]txVote, len(addrs))
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			vote := txVote{URL: addr}
+			resp, err := txCall(addr, "/2pc/prepare", rec)
+			if err != nil {
+				vote.Reason = err.Error()
+			} else {
+				body, _ := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				vote.Yes = resp.StatusCode == http.StatusOK
+				if !vote.Yes {
+					vote.Reason = strings.TrimSpace(string(body))
+				}
+			}
+			votes[i] = vote
+		}(i, addr)
+	}
+	wg.Wait()
+
+	for _, vote := range votes {
+		if !vote.Yes {
+			return votes, false
+		}
+	}
+	return votes, true
+}
+
+// deliverDecision sends the commit or abort to every other node, retrying in the background until all of them got it
+func deliverDecision(rec txRecord) {
+	path := "/2pc/commit"
+	if rec.State == "aborted" {
+		path = "/2pc/abort"
+	}
+
+	pending := otherNodes()
+	for attempt := 0; ; attempt++ {
+		var failed []string
+		for _, addr := range pending {
+			resp, err := txCall(addr, path, rec)
+			if err != nil {
+				failed = append(failed, addr)
+				continue
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+				failed = append(failed, addr)
+			}
+		}
+		if len(failed) == 0 {
+			done := rec
+			done.State = "done"
+			err := writeTxLog(done)
+			if err != nil {
+				log.Printf("Failed to write the transaction log: %s\n", err)
+			}
+			return
+		}
+		if attempt == 0 {
+			fmt.Printf("[2023 %s] %s SERVER [2PC]            [TX %s] %s not delivered to %v, retrying\n", time.Now().Format(time.StampNano), Role, rec.Tx, rec.State, failed)
+		}
+		pending = failed
+		time.Sleep(time.Second)
+	}
+}
+
+// AtomicWrite runs a client write as a two-phase commit with this node as coordinator
+func AtomicWrite(w http.ResponseWriter, r *http.Request) {
+	LogRequest(r, "Received ", r.Method, " request for two-phase commit")
+
+	var newMemo Memo
+	if r.Method != http.MethodPost {
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+		newMemo.ID = id
+	}
+	var requestBody map[string]string
+	if r.Method != http.MethodDelete {
+		err := json.NewDecoder(r.Body).Decode(&requestBody)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// the entry has to stay the next one in sequence until every node decided on it, so transactions never
+	// overlap. memosMu is released during the prepare round and the entry checked again before the commit.
+	coordMu.Lock()
+	defer coordMu.Unlock()
+
+	MemosMu.Lock()
+	if r.Method == http.MethodPost {
+		newMemo.ID = IDCount + 1
+		newMemo.Version = 1
+	} else if memo, ok := GetMemo(newMemo.ID); !ok {
+		MemosMu.Unlock()
+		http.Error(w, "Memo not found", http.StatusNotFound)
+		return
+	} else if !IfMatch(r, memo) {
+		MemosMu.Unlock()
+		PreconditionFailed(w, r, memo)
+		return
+	} else if r.Method == http.MethodDelete {
+		newMemo.Version = memo.Version
+	} else {
+		// a patch leaves the fields it does not name as they are, the entry carries the whole memo
+		if r.Method == http.MethodPatch {
+			newMemo.Title, newMemo.Body = memo.Title, memo.Body
+		}
+		newMemo.Version = memo.Version + 1
+	}
+	if value, ok := requestBody["title"]; ok || r.Method != http.MethodPatch {
+		newMemo.Title = value
+	}
+	if value, ok := requestBody["body"]; ok || r.Method != http.MethodPatch {
+		newMemo.Body = value
+	}
+
+	entry := LogEntry{Seq: LastSeq + 1, Method: r.Method, Memo: newMemo, Time: time.Now(), Base: baseVersion(r.Method, newMemo), Key: r.Header.Get("Idempotency-Key")}
+	if r.Method != http.MethodDelete {
+		// only the fields the client sent are edited, on the version it named in If-Match
+		var title, body *string
+		if value, ok := requestBody["title"]; ok {
+			title = &value
+		}
+		if value, ok := requestBody["body"]; ok {
+			body = &value
+		}
+		base, _ := parseVersion(r.Header.Get("If-Match"))
+		entry.Ops = crdtEdit(newMemo.ID, base, title, body)
+	}
+	rec := txRecord{Tx: fmt.Sprintf("%d-%d-%d", currentEpoch(), entry.Seq, time.Now().UnixNano()), Coordinator: SelfAddr, State: "prepared", Entry: entry}
+	MemosMu.Unlock()
+
+	err := writeTxLog(rec)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	votes, ok := prepareAll(rec)
+
+	MemosMu.Lock()
+	defer MemosMu.Unlock()
+	if ok {
+		// a new primary may have sent entries while memosMu was free
+		if reason := txConflict(entry); reason != "" {
+			votes = append(votes, txVote{URL: SelfAddr, Reason: reason})
+			ok = false
+		}
+	}
+	if !ok {
+		rec.State = "aborted"
+		err = writeTxLog(rec)
+		if err != nil {
+			log.Printf("Failed to write the transaction log: %s\n", err)
+		}
+		go deliverDecision(rec)
+
+		fmt.Printf("[2023 %s] %s SERVER [2PC]            [TX %s] ABORT %+v\n", time.Now().Format(time.StampNano), Role, rec.Tx, votes)
+		response, _ := json.Marshal(map[string]interface{}{
+			"msg":   "transaction aborted, no node applied the change",
+			"votes": votes,
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write(response)
+		return
+	}
+
+	rec.State = "committed"
+	err = writeTxLog(rec)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res := applyOrdered(entry)
+	go deliverDecision(rec)
+
+	fmt.Printf("[2023 %s] %s SERVER [2PC]            [TX %s] COMMIT seq %d\n", time.Now().Format(time.StampNano), Role, rec.Tx, entry.Seq)
+	w.Header().Set("X-Replica-Acks", fmt.Sprintf("%d/%d", len(votes), len(votes)))
+	SetConsistencyToken(w, entry.Seq)
+	if memo, ok := GetMemo(newMemo.ID); ok {
+		SetETag(w, memo)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(res.StatusCode)
+	_, _ = w.Write(res.Response)
+}
+
+// txConflict tells why the entry can no longer be applied as the next one, must be called with memosMu held
+func txConflict(entry LogEntry) string {
+	current, exists := GetMemo(entry.Memo.ID)
+	switch {
+	case entry.Seq != LastSeq+1:
+		return fmt.Sprintf("expected seq %d, got %d", LastSeq+1, entry.Seq)
+	case entry.Method == http.MethodPost && exists:
+		return fmt.Sprintf("memo %d exists already", entry.Memo.ID)
+	case entry.Method != http.MethodPost && !exists:
+		return fmt.Sprintf("memo %d not found", entry.Memo.ID)
+	case entry.Method != http.MethodPost && entry.Base != 0 && current.Version != entry.Base:
+		return fmt.Sprintf("memo %d is at version %d, not %d", entry.Memo.ID, current.Version, entry.Base)
+	}
+	return ""
+}
+
+// handlePrepare votes on a transaction, yes only when the entry is the next one and applies cleanly
+func handlePrepare(w http.ResponseWriter, r *http.Request) {
+	if !checkEpoch(w, r) {
+		return
+	}
+
+	var rec txRecord
+	err := json.NewDecoder(r.Body).Decode(&rec)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entry := rec.Entry
+
+	MemosMu.Lock()
+	defer MemosMu.Unlock()
+	txMu.Lock()
+	defer txMu.Unlock()
+
+	reason := ""
+	switch {
+	case preparedTx != nil && preparedTx.Tx != rec.Tx:
+		reason = "transaction " + preparedTx.Tx + " is still prepared"
+	case !Ready:
+		reason = "replica is catching up"
+	default:
+		reason = txConflict(entry)
+	}
+	if reason != "" {
+		fmt.Printf("[2023 %s] %s SERVER [2PC]            [TX %s] vote NO: %s\n", time.Now().Format(time.StampNano), Role, rec.Tx, reason)
+		http.Error(w, reason, http.StatusConflict)
+		return
+	}
+
+	rec.State = "prepared"
+	txStates[rec.Tx] = rec
+	preparedTx = &rec
+	preparedAt = time.Now()
+
+	fmt.Printf("[2023 %s] %s SERVER [2PC]            [TX %s] vote YES for seq %d\n", time.Now().Format(time.StampNano), Role, rec.Tx, entry.Seq)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(`{"msg": "prepared"}`))
+}
+
+// finishTx commits or aborts the prepared transaction, must be called with memosMu and txMu held
+func finishTx(tx string, state string) bool {
+	if preparedTx == nil || preparedTx.Tx != tx {
+		return false
+	}
+	rec := *preparedTx
+	rec.State = state
+	txStates[tx] = rec
+	preparedTx = nil
+
+	if state == "committed" {
+		applyOrdered(rec.Entry)
+	}
+	fmt.Printf("[2023 %s] %s SERVER [2PC]            [TX %s] %s\n", time.Now().Format(time.StampNano), Role, tx, state)
+	return true
+}
+
+// handleDecision serves /2pc/commit and /2pc/abort. Decisions are not fenced by epoch, a coordinator that
+// lost its role still has to finish what it decided. A decision for a transaction this node never prepared
+// is answered with 404, the node catches up through the log instead.
+func handleDecision(state string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var rec txRecord
+		err := json.NewDecoder(r.Body).Decode(&rec)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		MemosMu.Lock()
+		txMu.Lock()
+		finished := finishTx(rec.Tx, state)
+		known, ok := txStates[rec.Tx]
+		txMu.Unlock()
+		MemosMu.Unlock()
+
+		if !finished && (!ok || known.State != state) {
+			http.Error(w, "Transaction not prepared here", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"msg": "OK"}`))
+	}
+}
+
+// handleTxStatus tells a replica in doubt what this node knows about a transaction
+func handleTxStatus(w http.ResponseWriter, r *http.Request) {
+	tx := mux.Vars(r)["tx"]
+
+	txMu.Lock()
+	rec, ok := txStates[tx]
+	txMu.Unlock()
+
+	state := "unknown"
+	if ok {
+		state = rec.State
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = fmt.Fprintf(w, `{"tx": %q, "state": %q}`, tx, state)
+}
+
+func fetchTxState(addr string, tx string) (string, error) {
+	client := http.Client{Timeout: 500 * time.Millisecond}
+	resp, err := client.Get("http://" + addr + "/2pc/status/" + tx)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var status struct {
+		State string `json:"state"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	return status.State, err
+}
+
+// resolveInDoubt finishes a transaction that stayed prepared for too long. The coordinator decides, and
+// when it cannot be reached a replica that already committed or aborted decides for it. As long as every
+// reachable node is prepared as well, the transaction stays in doubt.
+func resolveInDoubt() {
+	for {
+		time.Sleep(time.Second)
+
+		txMu.Lock()
+		var rec txRecord
+		inDoubt := preparedTx != nil && time.Since(preparedAt) > failoverTimeout()
+		if inDoubt {
+			rec = *preparedTx
+		}
+		txMu.Unlock()
+		if !inDoubt {
+			continue
+		}
+
+		decision := ""
+		state, err := fetchTxState(rec.Coordinator, rec.Tx)
+		if err == nil && (state == "committed" || state == "aborted") {
+			decision = state
+		} else if err == nil && state == "unknown" {
+			// the coordinator logs every transaction before asking for votes, so it never started this one
+			decision = "aborted"
+		} else {
+			for _, addr := range otherNodes() {
+				state, err := fetchTxState(addr, rec.Tx)
+				if err == nil && (state == "committed" || state == "aborted") {
+					decision = state
+					break
+				}
+			}
+		}
+		if decision == "" {
+			fmt.Printf("[2023 %s] %s SERVER [2PC]            [TX %s] still in doubt\n", time.Now().Format(time.StampNano), Role, rec.Tx)
+			continue
+		}
+
+		MemosMu.Lock()
+		txMu.Lock()
+		finishTx(rec.Tx, decision)
+		txMu.Unlock()
+		MemosMu.Unlock()
+	}
+}
+
+// recoverTransactions replays the transaction log after a restart: transactions without a decision are
+// aborted, committed entries are applied here if they were not yet, and decisions that were not delivered
+// everywhere are sent again
+func recoverTransactions() {
+	data, err := ioutil.ReadFile(txLogPath())
+	if err != nil {
+		return
+	}
+
+	var order []string
+	latest := make(map[string]txRecord)
+	for _, line := range strings.Split(string(data), "\n") {
+		var rec txRecord
+		if strings.TrimSpace(line) == "" || json.Unmarshal([]byte(line), &rec) != nil {
+			continue
+		}
+		if _, ok := latest[rec.Tx]; !ok {
+			order = append(order, rec.Tx)
+		}
+		if rec.State == "done" {
+			rec.State = latest[rec.Tx].State + "/done"
+		}
+		latest[rec.Tx] = rec
+	}
+
+	for _, tx := range order {
+		rec := latest[tx]
+		if strings.TrimSuffix(rec.State, "/done") == "committed" {
+			MemosMu.Lock()
+			reapplyCommitted(rec)
+			MemosMu.Unlock()
+		}
+		if strings.HasSuffix(rec.State, "/done") {
+			rec.State = strings.TrimSuffix(rec.State, "/done")
+			txMu.Lock()
+			txStates[tx] = rec
+			txMu.Unlock()
+			continue
+		}
+		if rec.State == "prepared" {
+			rec.State = "aborted"
+			err := writeTxLog(rec)
+			if err != nil {
+				log.Printf("Failed to write the transaction log: %s\n", err)
+			}
+		} else {
+			txMu.Lock()
+			txStates[tx] = rec
+			txMu.Unlock()
+		}
+		fmt.Printf("[2023 %s] %s SERVER [2PC RECOVERY]   [TX %s] delivering %s\n", time.Now().Format(time.StampNano), Role, tx, rec.State)
+		go deliverDecision(rec)
+	}
+}
+
+// reapplyCommitted applies a committed entry the coordinator logged but may have crashed before applying,
+// it must be called with memosMu held. Entries up to lastSeq are applied already, so recovering twice
+// changes nothing. A node that lost the primary role leaves the entry to the catch-up from the new primary,
+// which may have assigned the sequence number to another write.
+func reapplyCommitted(rec txRecord) {
+	entry := rec.Entry
+	if entry.Seq <= LastSeq || !AmPrimary() {
+		return
+	}
+	if entry.Seq != LastSeq+1 {
+		log.Printf("Committed transaction %s has seq %d but only seq %d was applied, not applying it\n", rec.Tx, entry.Seq, LastSeq)
+		return
+	}
+	ApplyEntry(entry)
+	recordApplied(entry)
+	fmt.Printf("[2023 %s] %s SERVER [2PC RECOVERY]   [TX %s] applied committed seq %d\n", time.Now().Format(time.StampNano), Role, rec.Tx, entry.Seq)
+}
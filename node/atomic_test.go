@@ -0,0 +1,116 @@
+package node
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRecoverCommitted checks that a coordinator that crashed between logging a commit and applying it
+// applies the entry on restart, and only once
+func TestRecoverCommitted(t *testing.T) {
+	Config = Configuration{Sync: "atomic", TxLog: filepath.Join(t.TempDir(), "2pc.log"), Replicas: []string{"127.0.0.1:1"}}
+	SelfAddr = Config.Replicas[0]
+	MemoStore = &memoryStore{}
+	LastSeq, ReplLog, IDCount, Ready = 0, nil, 0, true
+	clusterMu.Lock()
+	isPrimary = true
+	clusterMu.Unlock()
+
+	entry := LogEntry{Seq: 1, Method: http.MethodPost, Memo: Memo{ID: 1, Title: "one", Version: 1}, Time: time.Now()}
+	var data []byte
+	for _, state := range []string{"prepared", "committed"} {
+		line, _ := json.Marshal(txRecord{Tx: "1-1-1", Coordinator: SelfAddr, State: state, Entry: entry})
+		data = append(append(data, line...), '\n')
+	}
+	if err := ioutil.WriteFile(Config.TxLog, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		txMu.Lock()
+		txLogFile.Close()
+		txLogFile = nil
+		txMu.Unlock()
+	}()
+
+	// the second restart finds the decision delivered as well
+	for restart := 1; restart <= 2; restart++ {
+		recoverTransactions()
+		waitDone(t, Config.TxLog)
+
+		MemosMu.Lock()
+		memos := AllMemos()
+		seq := LastSeq
+		MemosMu.Unlock()
+		if len(memos) != 1 || memos[0].Title != "one" || seq != 1 {
+			t.Fatalf("after recovery %d: memos %+v at seq %d, expected memo 1 at seq 1", restart, memos, seq)
+		}
+	}
+}
+
+// waitDone waits until the transaction log records that the decision reached every node
+func waitDone(t *testing.T, path string) {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		data, _ := ioutil.ReadFile(path)
+		if strings.Contains(string(data), `"state":"done"`) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("the decision was not delivered")
+}
+
+// TestPrepareReleasesMemos checks that the coordinator does not hold memosMu while the replicas prepare,
+// and aborts when the log moved on in the meantime
+func TestPrepareReleasesMemos(t *testing.T) {
+	preparing, release := make(chan struct{}), make(chan struct{})
+	replica := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/2pc/prepare" {
+			close(preparing)
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer replica.Close()
+
+	Config = Configuration{Sync: "atomic", TxLog: filepath.Join(t.TempDir(), "2pc.log"), Replicas: []string{"127.0.0.1:1", strings.TrimPrefix(replica.URL, "http://")}}
+	SelfAddr = Config.Replicas[0]
+	MemoStore = &memoryStore{}
+	LastSeq, ReplLog, IDCount, Ready = 0, nil, 0, true
+	defer func() {
+		txMu.Lock()
+		txLogFile.Close()
+		txLogFile = nil
+		txMu.Unlock()
+	}()
+
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		AtomicWrite(rec, httptest.NewRequest(http.MethodPost, "/note", strings.NewReader(`{"title": "one"}`)))
+		close(done)
+	}()
+
+	<-preparing
+	if !MemosMu.TryLock() {
+		close(release)
+		t.Fatal("memosMu is held during the prepare round")
+	}
+	// an entry from elsewhere takes the sequence number the transaction prepared
+	LastSeq = 1
+	MemosMu.Unlock()
+	close(release)
+	<-done
+
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("AtomicWrite returned %d, expected %d after the log moved on", rec.Code, http.StatusConflict)
+	}
+	waitDone(t, Config.TxLog)
+}
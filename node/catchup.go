@@ -0,0 +1,125 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+	Catch-up
+
+	A node that rejoins as a replica, for example this old primary after a failover, first installs a snapshot of the primary's memos,
+	then applies the log tail after the snapshot's sequence number. Updates that arrive meanwhile are buffered
+	and reads are refused with 503 until the node is ready.
+*/
+
+func catchUp() {
+	MemosMu.Lock()
+	if catchingUp {
+		MemosMu.Unlock()
+		return
+	}
+	catchingUp = true
+	MemosMu.Unlock()
+
+	for attempt := 1; ; attempt++ {
+		err := installSnapshot()
+		if err == nil {
+			break
+		}
+		log.Printf("Catch-up attempt %d failed: %s\n", attempt, err)
+		time.Sleep(time.Second)
+	}
+
+	MemosMu.Lock()
+	catchingUp = false
+	MemosMu.Unlock()
+}
+
+func installSnapshot() error {
+	primaryURL, err := GetPrimaryURL()
+	if err != nil {
+		return err
+	}
+
+	url := strings.TrimSuffix(primaryURL, "/note") + "/replication/snapshot"
+	fmt.Printf("[2023 %s] %s SERVER [CATCH-UP]    Request to [%s]\n", time.Now().Format(time.StampNano), Role, url)
+
+	resp, err := ReplicationClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("snapshot request failed: %s", resp.Status)
+	}
+	err = checkResponseEpoch(resp)
+	if err != nil {
+		return err
+	}
+
+	var snapshot snapshotState
+	err = json.NewDecoder(resp.Body).Decode(&snapshot)
+	if err != nil {
+		return err
+	}
+
+	snapshotMu.Lock()
+	MemosMu.Lock()
+	restoreSnapshot(snapshot)
+	err = saveInstalledSnapshot(snapshot)
+	if err != nil {
+		log.Fatalf("Failed to write the installed snapshot: %s\n", err)
+	}
+	publishProgress()
+	for seq := range PendingEntries {
+		if seq <= snapshot.Seq {
+			delete(PendingEntries, seq)
+		}
+	}
+	MemosMu.Unlock()
+	snapshotMu.Unlock()
+
+	fmt.Printf("[2023 %s] %s SERVER [CATCH-UP]    Installed snapshot at seq %d with %d memos\n", time.Now().Format(time.StampNano), Role, snapshot.Seq, len(snapshot.Memos))
+
+	// the tail covers writes made on the primary after the snapshot was taken
+	err = fetchLog(snapshot.Seq + 1)
+	if err != nil {
+		return err
+	}
+
+	MemosMu.Lock()
+	Ready = true
+	publishProgress()
+	drainPending()
+	if len(PendingEntries) > 0 {
+		scheduleGapFetch()
+	}
+	applied := LastSeq
+	MemosMu.Unlock()
+
+	fmt.Printf("[2023 %s] %s SERVER [CATCH-UP]    Ready at seq %d\n", time.Now().Format(time.StampNano), Role, applied)
+	return nil
+}
+
+// RefuseIfNotReady answers 503 to reads while the replica is still catching up
+func RefuseIfNotReady(w http.ResponseWriter, r *http.Request) bool {
+	MemosMu.Lock()
+	isReady := Ready
+	MemosMu.Unlock()
+
+	if isReady {
+		return false
+	}
+
+	w.Header().Set("Retry-After", "1")
+	w.Header().Set("X-Replica-Ready", "false")
+	http.Error(w, "Replica is catching up with the primary", http.StatusServiceUnavailable)
+	fmt.Printf("[2023 %s] %s SERVER [REPLY]   [METHOD: %s] Not ready, catching up\n", time.Now().Format(time.StampNano), Role, r.Method)
+	return true
+}
@@ -0,0 +1,91 @@
+package node
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+/*
+	Chain replication ("sync": "chain")
+
+	The nodes form a chain in the order of Replicas, headed by the primary. A write is applied at the head
+	and handed on by every node to its successor, so the reply of the tail travels back up the chain as the
+	acknowledgement: a node marks its reply X-Chain-Confirmed only when it is the tail or its successor's
+	reply was marked, so a node that merely buffered the entry does not count. Reads are served by the
+	tail. Nodes that are down or still catching up are left out: a node skips a successor it cannot reach,
+	and heartbeats keep a node out until it is ready again. A node that was skipped over may miss entries,
+	it buffers what comes after the gap and fetches the rest from the primary like any replica.
+*/
+
+// chainMembers returns the live nodes of the chain in order, starting at the primary
+func chainMembers() []string {
+	clusterMu.Lock()
+	defer clusterMu.Unlock()
+
+	members := []string{CurrentPrimary}
+	for _, addr := range Config.Replicas {
+		if addr == CurrentPrimary {
+			continue
+		}
+		if addr == SelfAddr {
+			if nodeReady {
+				members = append(members, addr)
+			}
+			continue
+		}
+		if p, ok := peers[addr]; ok && p.hb.Ready && time.Since(p.lastSeen) < failoverTimeout() {
+			members = append(members, addr)
+		}
+	}
+	return members
+}
+
+// chainSuccessors returns the nodes after this one, nothing when this node is the tail or not in the chain
+func chainSuccessors() []string {
+	members := chainMembers()
+	for i, addr := range members {
+		if addr == SelfAddr {
+			return members[i+1:]
+		}
+	}
+	return nil
+}
+
+func chainTail() string {
+	members := chainMembers()
+	return members[len(members)-1]
+}
+
+// ChainForward hands the entry to the successor, repairing the chain around successors that cannot be
+// reached. It returns false when there is nobody left after this node, which makes this node the tail.
+// The result is only acknowledged when the tail confirmed the entry.
+func ChainForward(entry LogEntry) (ReplicaResult, bool) {
+	for _, next := range chainSuccessors() {
+		res := SendEntry(next, entry)
+		if res.Err == nil {
+			if res.Acked() && !res.Confirmed {
+				res.Err = fmt.Errorf("seq %d not confirmed by the tail (%d)", entry.Seq, res.StatusCode)
+			}
+			return res, true
+		}
+		fmt.Printf("[2023 %s] %s SERVER [CHAIN REPAIR]   successor [%s] failed (%s), skipping it\n", time.Now().Format(time.StampNano), Role, next, res.Err)
+	}
+	return ReplicaResult{}, false
+}
+
+// ChainRead sends a client read to the tail, a read that was forwarded once is always served locally
+func ChainRead(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Chain-Read") == "true" {
+		return false
+	}
+	tail := chainTail()
+	if tail == SelfAddr {
+		return false
+	}
+
+	fmt.Printf("[2023 %s] %s SERVER [CHAIN READ]     [METHOD: %s] to tail [%s]\n", time.Now().Format(time.StampNano), Role, r.Method, tail)
+	r.Header.Set("Chain-Read", "true")
+	ProxyRequest(w, r, "http://"+tail+r.URL.Path)
+	return true
+}
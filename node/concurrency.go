@@ -0,0 +1,91 @@
+package node
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Optimistic concurrency
+
+	Every memo carries a version, a new memo starts at 1 and every write raises it by one. GET returns it
+	as ETag and a PUT, PATCH or DELETE with If-Match is refused with 412 when the memo is at another version.
+	Replicas pass If-Match on to the primary unchanged. Replicated updates carry the version they were made
+	on in If-Match (Base in the log), a node that holds another version refuses them the same way and the
+	primary counts that as a failed ack. Quorum mode tags memos with its own versions and multi-primary mode
+	with the stamp of the write. With crdt on, a PUT or PATCH made on an older version the memo's document
+	still remembers is accepted as well and merged with the writes since.
+*/
+
+func memoETag(memo Memo) string {
+	switch Config.Sync {
+	case "quorum":
+		return fmt.Sprintf("\"%d-%s\"", memo.Version, memo.VersionNode)
+	case "multi-primary":
+		return fmt.Sprintf("\"%d-%s\"", memo.HLC, memo.VersionNode)
+	}
+	return fmt.Sprintf("\"%d\"", memo.Version)
+}
+
+// IfMatch reports whether the request's If-Match accepts the memo, a request without one accepts any. An
+// older version is only accepted where crdtEnabled, not in local-write, quorum, raft or multi-primary mode.
+// It must be called with memosMu held
+func IfMatch(r *http.Request, memo Memo) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+	etag := memoETag(memo)
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+		if crdtMerges(r) {
+			if version, err := parseVersion(candidate); err == nil && crdtKnows(memo.ID, version) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// crdtMerges tells whether the request is an edit CRDTMerge can merge
+func crdtMerges(r *http.Request) bool {
+	return crdtEnabled() && Config.Sync != "multi-primary" && (r.Method == http.MethodPut || r.Method == http.MethodPatch)
+}
+
+// parseVersion returns the version in an If-Match header, 0 when there is none or it matches any version
+func parseVersion(header string) (uint64, error) {
+	header = strings.TrimSpace(header)
+	if header == "" || header == "*" {
+		return 0, nil
+	}
+	return strconv.ParseUint(strings.Trim(header, "\""), 10, 64)
+}
+
+// baseVersion is the version a write was made on, 0 for a new memo
+func baseVersion(method string, newMemo Memo) uint64 {
+	switch method {
+	case http.MethodPut, http.MethodPatch:
+		if newMemo.Version > 0 {
+			return newMemo.Version - 1
+		}
+	case http.MethodDelete:
+		return newMemo.Version
+	}
+	return 0
+}
+
+func SetETag(w http.ResponseWriter, memo Memo) {
+	w.Header().Set("ETag", memoETag(memo))
+}
+
+func PreconditionFailed(w http.ResponseWriter, r *http.Request, memo Memo) {
+	SetETag(w, memo)
+	http.Error(w, fmt.Sprintf("Memo %d is at version %s", memo.ID, memoETag(memo)), http.StatusPreconditionFailed)
+	fmt.Printf("[2023 %s] %s SERVER [PRECONDITION]   [METHOD: %s] memo %d is at %s, If-Match %s\n", time.Now().Format(time.StampNano), Role, r.Method, memo.ID, memoETag(memo), r.Header.Get("If-Match"))
+}
@@ -0,0 +1,157 @@
+package node
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Consistency levels
+
+	Clients pick per request with X-Consistency how much confirmation they need:
+	  one      a read is served by the node it reached, a write is acknowledged once the primary stored it
+	  primary  a read is served by the primary, a write behaves like one
+	  quorum   a read asks every node and answers with the most up-to-date of the first majority to reply,
+	           a write waits until a majority of nodes, the primary included, stored it
+	  all      like quorum, with every node
+	Without the header reads are local and writes follow the configured ack mode. The chosen level is echoed
+	in X-Consistency, and how it was met in X-Consistency-Served for reads and X-Consistency-Confirmed.
+*/
+
+var consistencyLevels = map[string]bool{"one": true, "primary": true, "quorum": true, "all": true}
+
+// ConsistencyLevel validates and echoes the requested level, false means the request was answered with 400
+func ConsistencyLevel(w http.ResponseWriter, r *http.Request) bool {
+	level := r.Header.Get("X-Consistency")
+	if level == "" {
+		return true
+	}
+	if !consistencyLevels[level] {
+		http.Error(w, "X-Consistency must be one, primary, quorum or all", http.StatusBadRequest)
+		return false
+	}
+	w.Header().Set("X-Consistency", level)
+	return true
+}
+
+// NodesNeeded returns how many nodes, this one included, have to confirm a request at the level
+func NodesNeeded(level string) int {
+	switch level {
+	case "quorum":
+		return len(Config.Replicas)/2 + 1
+	case "all":
+		return len(Config.Replicas)
+	}
+	return 1
+}
+
+// ConsistentRead serves a GET at the requested level, it returns false when this node should answer locally
+func ConsistentRead(w http.ResponseWriter, r *http.Request) bool {
+	level := r.Header.Get("X-Consistency")
+	switch level {
+	case "primary":
+		if !AmPrimary() {
+			primaryURL, err := GetPrimaryURL()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return true
+			}
+			ProxyRequest(w, r, strings.TrimSuffix(primaryURL, "/note")+r.URL.Path)
+			return true
+		}
+	case "quorum", "all":
+		gatherRead(w, r, level)
+		return true
+	}
+
+	MemosMu.Lock()
+	applied := LastSeq
+	MemosMu.Unlock()
+
+	served := "local " + SelfAddr
+	if AmPrimary() {
+		served = "primary " + SelfAddr
+	}
+	w.Header().Set("X-Applied-Seq", strconv.FormatUint(applied, 10))
+	if level != "" {
+		w.Header().Set("X-Consistency-Served", served)
+	}
+	return false
+}
+
+// nodeRead is one node's answer to a quorum or all read
+type nodeRead struct {
+	addr   string
+	status int
+	seq    uint64
+	header http.Header
+	body   []byte
+	err    error
+}
+
+// gatherRead reads from every node at level one and answers with the most up-to-date reply once enough
+// nodes answered
+func gatherRead(w http.ResponseWriter, r *http.Request, level string) {
+	client := http.Client{Timeout: 2 * time.Second}
+	readCh := make(chan nodeRead, len(Config.Replicas))
+	for _, addr := range Config.Replicas {
+		go func(addr string) {
+			res := nodeRead{addr: addr}
+			req, err := http.NewRequest(http.MethodGet, "http://"+addr+r.URL.Path, nil)
+			if err != nil {
+				res.err = err
+				readCh <- res
+				return
+			}
+			req.Header.Set("X-Consistency", "one")
+
+			resp, err := client.Do(req)
+			if err != nil {
+				res.err = err
+				readCh <- res
+				return
+			}
+			defer resp.Body.Close()
+			res.status = resp.StatusCode
+			res.header = resp.Header
+			res.seq, _ = strconv.ParseUint(resp.Header.Get("X-Applied-Seq"), 10, 64)
+			res.body, res.err = ioutil.ReadAll(resp.Body)
+			readCh <- res
+		}(addr)
+	}
+
+	need := NodesNeeded(level)
+	var best nodeRead
+	confirmed := 0
+	for range Config.Replicas {
+		res := <-readCh
+		// a missing memo is a valid answer, a node that is down or catching up is not
+		if res.err != nil || (res.status != http.StatusOK && res.status != http.StatusNotFound) {
+			continue
+		}
+		confirmed++
+		if confirmed == 1 || res.seq > best.seq {
+			best = res
+		}
+		if confirmed >= need {
+			break
+		}
+	}
+
+	w.Header().Set("X-Consistency-Confirmed", fmt.Sprintf("%d/%d", confirmed, len(Config.Replicas)))
+	if confirmed < need {
+		http.Error(w, fmt.Sprintf("only %d of %d nodes answered the read", confirmed, need), http.StatusServiceUnavailable)
+		return
+	}
+
+	fmt.Printf("[2023 %s] %s SERVER [CONSISTENCY]    [METHOD: %s] %s read served by [%s] at seq %d\n", time.Now().Format(time.StampNano), Role, r.Method, level, best.addr, best.seq)
+	w.Header().Set("X-Consistency-Served", fmt.Sprintf("%s at seq %d", best.addr, best.seq))
+	w.Header().Set("X-Applied-Seq", strconv.FormatUint(best.seq, 10))
+	w.Header().Set("Content-Type", best.header.Get("Content-Type"))
+	w.WriteHeader(best.status)
+	_, _ = w.Write(best.body)
+}
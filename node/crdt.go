@@ -0,0 +1,518 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	CRDT memos ("crdt": true)
+
+	The body of every memo is kept as a sequence CRDT: each character has an ID made of a Lamport counter
+	and the node that inserted it, and remembers the character it was inserted after. Concurrent inserts
+	after the same character are ordered by their IDs, deleted characters stay behind as tombstones. The
+	title is a last-writer-wins register stamped with the hybrid logical clock.
+
+	A write is turned into operations by diffing the new body against the one it was made on: the version
+	named in If-Match, which may be older than the current one as long as the document still remembers it,
+	or the current one without If-Match. Edits made since that version are therefore kept, not overwritten.
+	The operations travel with the update in "ops" next to the memo fields. A node applies the operations, so two edits of
+	different parts of the same body made concurrently on different nodes both survive. An operation whose
+	character is not known yet waits until it is, and the node then fetches the whole document from the
+	node that sent it. The memo fields are used while operations are waiting. Raft, quorum and local-write
+	mode keep whole fields.
+*/
+
+// crdtID identifies one character of a body
+type crdtID struct {
+	Counter uint64 `json:"c"`
+	Node    string `json:"n"`
+}
+
+func (id crdtID) greater(other crdtID) bool {
+	if id.Counter != other.Counter {
+		return id.Counter > other.Counter
+	}
+	return id.Node > other.Node
+}
+
+// textOp inserts a character after another one, a zero After inserts at the start, or deletes one
+type textOp struct {
+	ID     crdtID `json:"id"`
+	After  crdtID `json:"after"`
+	Char   string `json:"char,omitempty"`
+	Delete bool   `json:"delete,omitempty"`
+}
+
+type lwwRegister struct {
+	Value string `json:"value"`
+	Stamp uint64 `json:"stamp"`
+	Node  string `json:"node"`
+}
+
+// crdtOps is what an update carries, the operations of one write or the whole state of a memo
+type crdtOps struct {
+	Title *lwwRegister `json:"title,omitempty"`
+	Body  []textOp     `json:"body,omitempty"`
+}
+
+type crdtChar struct {
+	ID      crdtID
+	After   crdtID
+	Char    string
+	Deleted bool
+}
+
+type textDoc struct {
+	title   lwwRegister
+	chars   []crdtChar
+	pending []textOp
+	history map[uint64]docVersion // memo version -> what the document showed at that version
+}
+
+// docVersion is what a document showed at one memo version
+type docVersion struct {
+	title string
+	chars []crdtID // visible characters in document order
+}
+
+// replicationBody is the body of a replicated update
+type replicationBody struct {
+	Memo
+	Ops *crdtOps `json:"ops,omitempty"`
+}
+
+var (
+	crdtDocs   = make(map[int]*textDoc) // memo ID -> document, guarded by memosMu
+	crdtClock  uint64
+	crdtStaged = make(map[int]stagedEdit) // memo ID -> merged client edit, until the write is logged
+)
+
+// stagedEdit holds the operations of a merged client edit and the memo version the write produces
+type stagedEdit struct {
+	ops     *crdtOps
+	version uint64
+}
+
+// edits can be made on one of the last crdtHistory versions of a memo
+const crdtHistory = 32
+
+func crdtEnabled() bool {
+	return Config.CRDT && Config.Sync != "local-write" && Config.Sync != "quorum" && Config.Sync != "raft"
+}
+
+func (d *textDoc) index(id crdtID) int {
+	for i, ch := range d.chars {
+		if ch.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// integrate applies one operation, it returns false when the operation refers to a character we do not have
+func (d *textDoc) integrate(op textOp) bool {
+	i := d.index(op.ID)
+	if op.Delete {
+		if i < 0 {
+			return false
+		}
+		d.chars[i].Deleted = true
+		return true
+	}
+	if i >= 0 {
+		return true
+	}
+
+	pos := 0
+	if op.After.Counter != 0 {
+		after := d.index(op.After)
+		if after < 0 {
+			return false
+		}
+		pos = after + 1
+	}
+	// later inserts after the same character come first, skipping them also skips what was inserted after them
+	for pos < len(d.chars) && d.chars[pos].ID.greater(op.ID) {
+		pos++
+	}
+	d.chars = append(d.chars, crdtChar{})
+	copy(d.chars[pos+1:], d.chars[pos:])
+	d.chars[pos] = crdtChar{ID: op.ID, After: op.After, Char: op.Char}
+	if op.ID.Counter > crdtClock {
+		crdtClock = op.ID.Counter
+	}
+	return true
+}
+
+// visible returns what the document shows now
+func (d *textDoc) visible() docVersion {
+	version := docVersion{title: d.title.Value}
+	for _, ch := range d.chars {
+		if !ch.Deleted {
+			version.chars = append(version.chars, ch.ID)
+		}
+	}
+	return version
+}
+
+// remember records what the document shows as the given memo version, forgetting the oldest one
+func (d *textDoc) remember(version uint64) {
+	if d.history == nil {
+		d.history = make(map[uint64]docVersion)
+	}
+	d.history[version] = d.visible()
+	if len(d.history) > crdtHistory {
+		oldest := version
+		for v := range d.history {
+			if v < oldest {
+				oldest = v
+			}
+		}
+		delete(d.history, oldest)
+	}
+}
+
+func (d *textDoc) tombstones() int {
+	count := 0
+	for _, ch := range d.chars {
+		if ch.Deleted {
+			count++
+		}
+	}
+	return count
+}
+
+func (d *textDoc) text() string {
+	var sb strings.Builder
+	for _, ch := range d.chars {
+		if !ch.Deleted {
+			sb.WriteString(ch.Char)
+		}
+	}
+	return sb.String()
+}
+
+// state returns operations that rebuild the whole document, tombstones included
+func (d *textDoc) state() *crdtOps {
+	ops := &crdtOps{}
+	if d.title.Stamp != 0 {
+		title := d.title
+		ops.Title = &title
+	}
+	for _, ch := range d.chars {
+		ops.Body = append(ops.Body, textOp{ID: ch.ID, After: ch.After, Char: ch.Char})
+	}
+	for _, ch := range d.chars {
+		if ch.Deleted {
+			ops.Body = append(ops.Body, textOp{ID: ch.ID, Delete: true})
+		}
+	}
+	return ops
+}
+
+// crdtApply merges operations into the memo's document and reports whether it changed, must be called
+// with memosMu held
+func crdtApply(id int, ops *crdtOps) bool {
+	doc, ok := crdtDocs[id]
+	if !ok {
+		doc = &textDoc{}
+		crdtDocs[id] = doc
+	}
+
+	changed := false
+	if t := ops.Title; t != nil && (t.Stamp > doc.title.Stamp || (t.Stamp == doc.title.Stamp && t.Node > doc.title.Node)) {
+		doc.title = *t
+		changed = true
+	}
+
+	size, deleted := len(doc.chars), doc.tombstones()
+	queue := append(doc.pending, ops.Body...)
+	doc.pending = nil
+	for progress := true; progress && len(queue) > 0; {
+		progress = false
+		var waiting []textOp
+		for _, op := range queue {
+			if doc.integrate(op) {
+				progress = true
+			} else {
+				waiting = append(waiting, op)
+			}
+		}
+		queue = waiting
+	}
+	doc.pending = queue
+	return changed || len(doc.chars) != size || doc.tombstones() != deleted
+}
+
+// crdtEdit returns the operations that turn the memo's document as it was at the base version into the
+// given title and body, the current document when base is 0 or forgotten. A nil field is not edited. It
+// must be called with memosMu held
+func crdtEdit(id int, base uint64, title *string, body *string) *crdtOps {
+	if !crdtEnabled() {
+		return nil
+	}
+	doc, ok := crdtDocs[id]
+	if !ok {
+		doc = &textDoc{}
+	}
+	from := doc.visible()
+	if version, known := doc.history[base]; base != 0 && known {
+		from = version
+	}
+
+	ops := &crdtOps{}
+	if title != nil && (!ok || from.title != *title) {
+		ops.Title = &lwwRegister{Value: *title, Stamp: hlcNow(), Node: SelfAddr}
+	}
+	if body == nil {
+		return ops
+	}
+
+	chars := make(map[crdtID]string, len(doc.chars))
+	for _, ch := range doc.chars {
+		chars[ch.ID] = ch.Char
+	}
+	var old []rune
+	for _, id := range from.chars {
+		old = append(old, []rune(chars[id])...)
+	}
+	next := []rune(*body)
+	prefix := 0
+	for prefix < len(old) && prefix < len(next) && old[prefix] == next[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(old)-prefix && suffix < len(next)-prefix && old[len(old)-1-suffix] == next[len(next)-1-suffix] {
+		suffix++
+	}
+
+	for _, id := range from.chars[prefix : len(old)-suffix] {
+		ops.Body = append(ops.Body, textOp{ID: id, Delete: true})
+	}
+	var after crdtID
+	if prefix > 0 {
+		after = from.chars[prefix-1]
+	}
+	for _, r := range next[prefix : len(next)-suffix] {
+		crdtClock++
+		op := textOp{ID: crdtID{Counter: crdtClock, Node: SelfAddr}, After: after, Char: string(r)}
+		ops.Body = append(ops.Body, op)
+		after = op.ID
+	}
+	return ops
+}
+
+// CRDTMerge merges a client edit into the memo's document, the edit was made on the version named in
+// If-Match. Title and body point at the edited fields, nil for a field the edit leaves alone, and are set
+// to the merged result which the caller then stores. It must be called with memosMu held.
+func CRDTMerge(r *http.Request, id int, title *string, body *string) {
+	if !crdtMerges(r) {
+		return
+	}
+	memo, ok := GetMemo(id)
+	if !ok {
+		return
+	}
+	base, _ := parseVersion(r.Header.Get("If-Match"))
+	ops := crdtEdit(id, base, title, body)
+	crdtApply(id, ops)
+	crdtStaged[id] = stagedEdit{ops: ops, version: memo.Version + 1}
+
+	mergedTitle, mergedBody, ok := crdtText(id)
+	if !ok {
+		return
+	}
+	if title != nil {
+		*title = mergedTitle
+	}
+	if body != nil {
+		*body = mergedBody
+	}
+}
+
+// crdtKnows reports whether an edit can still be made on the given version of a memo, must be called with
+// memosMu held
+func crdtKnows(id int, version uint64) bool {
+	doc, ok := crdtDocs[id]
+	if !ok {
+		return false
+	}
+	_, known := doc.history[version]
+	return known
+}
+
+// crdtText returns the memo's title and body from its document, ok is false while operations are waiting
+func crdtText(id int) (string, string, bool) {
+	doc, ok := crdtDocs[id]
+	if !ok || len(doc.pending) > 0 {
+		return "", "", false
+	}
+	return doc.title.Value, doc.text(), true
+}
+
+// crdtRecord returns the operations of a write the primary just applied, those of the merged client edit or
+// else the difference to the current document. It must be called with memosMu held
+func crdtRecord(method string, id int) *crdtOps {
+	if !crdtEnabled() {
+		return nil
+	}
+	if method == http.MethodDelete {
+		delete(crdtDocs, id)
+		return nil
+	}
+	memo, ok := GetMemo(id)
+	if !ok {
+		return nil
+	}
+	// a write that failed after its merge leaves an edit for another version behind
+	staged, ok := crdtStaged[id]
+	delete(crdtStaged, id)
+	ops := staged.ops
+	if !ok || staged.version != memo.Version {
+		ops = crdtEdit(id, 0, &memo.Title, &memo.Body)
+		crdtApply(id, ops)
+	}
+	crdtDocs[id].remember(memo.Version)
+	return ops
+}
+
+// crdtApplyEntry applies the operations of a replicated update and returns the memo they produce, the
+// update's own memo while the document waits for missing operations
+func crdtApplyEntry(entry LogEntry) Memo {
+	newMemo := entry.Memo
+	crdtApply(newMemo.ID, entry.Ops)
+	title, body, ok := crdtText(newMemo.ID)
+	if !ok {
+		go crdtResync(newMemo.ID, "")
+		return newMemo
+	}
+	// after a failover this node takes edits made on the versions it saw
+	crdtDocs[newMemo.ID].remember(newMemo.Version)
+	newMemo.Title, newMemo.Body = title, body
+	return newMemo
+}
+
+// crdtSnapshot returns the state of every document, must be called with memosMu held
+func crdtSnapshot() map[int]*crdtOps {
+	if !crdtEnabled() {
+		return nil
+	}
+	docs := make(map[int]*crdtOps, len(crdtDocs))
+	for id, doc := range crdtDocs {
+		docs[id] = doc.state()
+	}
+	return docs
+}
+
+// handleCRDTDoc serves the whole document of a memo
+func handleCRDTDoc(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	MemosMu.Lock()
+	doc, ok := crdtDocs[id]
+	var state *crdtOps
+	if ok {
+		state = doc.state()
+	}
+	MemosMu.Unlock()
+	if !ok {
+		http.Error(w, "Memo not found", http.StatusNotFound)
+		return
+	}
+
+	response, err := json.Marshal(state)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(response)
+}
+
+// crdtResync merges the whole document of a memo from another node, the primary when addr is empty
+func crdtResync(id int, addr string) {
+	if addr == "" {
+		clusterMu.Lock()
+		addr = CurrentPrimary
+		clusterMu.Unlock()
+	}
+	if addr == "" || addr == SelfAddr {
+		return
+	}
+
+	client := http.Client{Timeout: heartbeatInterval()}
+	resp, err := client.Get(fmt.Sprintf("http://%s/crdt/doc/%d", addr, id))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	var state crdtOps
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&state) != nil {
+		return
+	}
+
+	MemosMu.Lock()
+	defer MemosMu.Unlock()
+	crdtApply(id, &state)
+	title, body, ok := crdtText(id)
+	if !ok {
+		return
+	}
+	if memo, found := GetMemo(id); found {
+		memo.Title, memo.Body = title, body
+		upsertMemo(memo)
+	}
+	if versions := mpVersions[id]; len(versions) == 1 {
+		versions[0].Memo.Title, versions[0].Memo.Body = title, body
+		mpPublish(id)
+	}
+	fmt.Printf("[2023 %s] %s SERVER [CRDT]           memo %d resynced from [%s]\n", time.Now().Format(time.StampNano), Role, id, addr)
+}
+
+// mpMergeOps merges a version in multi-primary mode with CRDT memos, concurrent versions never conflict:
+// their operations are merged and their clocks as well, must be called with memosMu held
+func mpMergeOps(rec quorumRecord) bool {
+	id := rec.Memo.ID
+	changed := rec.Ops != nil && crdtApply(id, rec.Ops)
+	merged := rec
+	merged.Ops = nil
+
+	if current := mpVersions[id]; len(current) > 0 {
+		mine := current[0]
+		if mine.Memo.Clock.descends(rec.Memo.Clock) && !changed {
+			return false
+		}
+		merged.Memo.Clock = mine.Memo.Clock.merge(rec.Memo.Clock)
+		if laterWrite(mine.Memo, rec.Memo) {
+			merged.Memo.HLC, merged.Memo.VersionNode = mine.Memo.HLC, mine.Memo.VersionNode
+		}
+		// a delete only wins over the edits it has seen
+		if mine.Deleted != rec.Deleted {
+			deleted, alive := mine, rec
+			if rec.Deleted {
+				deleted, alive = rec, mine
+			}
+			merged.Deleted = deleted.Memo.Clock.descends(alive.Memo.Clock)
+		}
+	}
+
+	if title, body, ok := crdtText(id); ok {
+		merged.Memo.Title, merged.Memo.Body = title, body
+	} else if rec.Ops != nil {
+		go crdtResync(id, rec.Memo.VersionNode)
+	}
+	mpVersions[id] = []quorumRecord{merged}
+	mpPublish(id)
+	return true
+}
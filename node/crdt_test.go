@@ -0,0 +1,82 @@
+package node
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestCRDTMergesEditsOnTheSameBase checks that two edits made on the same version both survive, the second
+// one is diffed against that version and not against the memo the first one left behind
+func TestCRDTMergesEditsOnTheSameBase(t *testing.T) {
+	Config = Configuration{Replicas: []string{"127.0.0.1:1"}, CRDT: true}
+	SelfAddr = Config.Replicas[0]
+	MemoStore = &memoryStore{}
+	crdtDocs = make(map[int]*textDoc)
+	crdtStaged = make(map[int]stagedEdit)
+
+	MemosMu.Lock()
+	defer MemosMu.Unlock()
+	upsertMemo(Memo{ID: 1, Title: "greeting", Body: "hello world", Version: 1})
+	crdtRecord(http.MethodPost, 1)
+
+	edit := func(method string, body string) (Memo, bool) {
+		r := httptest.NewRequest(method, "/note/1", strings.NewReader(""))
+		r.Header.Set("If-Match", `"1"`)
+		memo, _ := GetMemo(1)
+		if !IfMatch(r, memo) {
+			return memo, false
+		}
+		CRDTMerge(r, 1, nil, &body)
+		memo.Body = body
+		memo.Version++
+		upsertMemo(memo)
+		if crdtRecord(method, 1) == nil {
+			t.Fatalf("%s on version 1 recorded no operations", method)
+		}
+		return memo, true
+	}
+
+	if _, ok := edit(http.MethodPatch, "HELLO world"); !ok {
+		t.Fatalf("edit on the current version refused")
+	}
+	memo, ok := edit(http.MethodPatch, "hello there world")
+	if !ok {
+		t.Fatalf("edit on a remembered version refused")
+	}
+	if memo.Body != "HELLO there world" || memo.Title != "greeting" {
+		t.Fatalf("merged memo %+v, expected both edits in the body", memo)
+	}
+	if title, body, _ := crdtText(1); title != memo.Title || body != memo.Body {
+		t.Fatalf("document shows %q %q, the memo %q %q", title, body, memo.Title, memo.Body)
+	}
+
+	// only edits are merged, a delete on an older version is still refused
+	r := httptest.NewRequest(http.MethodDelete, "/note/1", nil)
+	r.Header.Set("If-Match", `"1"`)
+	if IfMatch(r, memo) {
+		t.Fatalf("delete on version 1 accepted at version %d", memo.Version)
+	}
+}
+
+// TestIfMatchWithoutCRDT checks that the modes without CRDT merging refuse an edit on an older version even
+// when crdt is on in config.json and the memo's document still remembers that version
+func TestIfMatchWithoutCRDT(t *testing.T) {
+	MemoStore = &memoryStore{}
+	crdtDocs = map[int]*textDoc{1: {history: map[uint64]docVersion{1: {}}}}
+	memo := Memo{ID: 1, Title: "one", Version: 2, VersionNode: "127.0.0.1:1"}
+
+	for _, mode := range []string{"remote-write", "local-write", "quorum", "raft", "multi-primary"} {
+		Config = Configuration{Sync: mode, Replicas: []string{"127.0.0.1:1"}, CRDT: true}
+		r := httptest.NewRequest(http.MethodPatch, "/note/1", strings.NewReader(""))
+		r.Header.Set("If-Match", `"1"`)
+
+		MemosMu.Lock()
+		accepted := IfMatch(r, memo)
+		MemosMu.Unlock()
+		if accepted != (mode == "remote-write") {
+			t.Fatalf("%s: If-Match on version 1 of a memo at version 2 accepted=%v", mode, accepted)
+		}
+	}
+}
@@ -0,0 +1,428 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+	Heartbeats and failover
+
+	Every node pings every other node on /cluster/heartbeat. A node that has not heard from the primary for
+	failoverTimeoutMs picks the replacement among the live, caught-up nodes: the one with the highest applied
+	sequence number, ties going to the lower index in config.json. The chosen node promotes itself with the
+	next term and announces itself on /cluster/primary. A primary that learns about a higher term, for example
+	an old primary coming back, steps down and rejoins as a replica.
+*/
+
+type heartbeat struct {
+	Node      string `json:"node"`
+	Primary   string `json:"primary"`
+	IsPrimary bool   `json:"isPrimary"`
+	Term      uint64 `json:"term"`
+	LastSeq   uint64 `json:"lastSeq"`
+	Ready     bool   `json:"ready"`
+}
+
+type peerState struct {
+	lastSeen time.Time
+	hb       heartbeat
+}
+
+var (
+	clusterMu      sync.Mutex // never held while acquiring memosMu
+	CurrentPrimary string
+	isPrimary      bool
+	term           uint64 = 1
+	nodeSeq        uint64 // mirrors the applied sequence number so heartbeats never wait on memosMu
+	nodeReady      bool
+	peers          = make(map[string]*peerState)
+	behindSince    time.Time
+	startedAt      = time.Now()
+	announcing     sync.WaitGroup // announcePrimary calls in flight, tests wait for them
+)
+
+func heartbeatInterval() time.Duration {
+	if Config.HeartbeatIntervalMs <= 0 {
+		return 500 * time.Millisecond
+	}
+	return time.Duration(Config.HeartbeatIntervalMs) * time.Millisecond
+}
+
+func failoverTimeout() time.Duration {
+	if Config.FailoverTimeoutMs <= 0 {
+		return 3 * time.Second
+	}
+	return time.Duration(Config.FailoverTimeoutMs) * time.Millisecond
+}
+
+func AmPrimary() bool {
+	clusterMu.Lock()
+	defer clusterMu.Unlock()
+	return isPrimary
+}
+
+func GetPrimaryURL() (string, error) {
+	clusterMu.Lock()
+	defer clusterMu.Unlock()
+
+	if CurrentPrimary == "" {
+		return "", fmt.Errorf("primary is not known yet")
+	}
+	return "http://" + CurrentPrimary + "/note", nil
+}
+
+// publishProgress must be called with memosMu held
+func publishProgress() {
+	clusterMu.Lock()
+	nodeSeq = LastSeq
+	nodeReady = Ready
+	if nodeSeq >= primarySeqSeen {
+		syncedAt = time.Now()
+	}
+	clusterMu.Unlock()
+}
+
+func localHeartbeat() heartbeat {
+	// in raft mode the leader plays the primary, so the load balancer still finds it
+	if raft != nil {
+		raftTerm, isLeader, leader := raft.Status()
+		return heartbeat{Node: SelfAddr, Primary: leader, IsPrimary: isLeader, Term: raftTerm, Ready: true}
+	}
+
+	clusterMu.Lock()
+	defer clusterMu.Unlock()
+
+	return heartbeat{
+		Node:      SelfAddr,
+		Primary:   CurrentPrimary,
+		IsPrimary: isPrimary,
+		Term:      term,
+		LastSeq:   nodeSeq,
+		Ready:     nodeReady,
+	}
+}
+
+func handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	response, err := json.Marshal(localHeartbeat())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(response)
+}
+
+func fetchHeartbeat(addr string) (heartbeat, error) {
+	var hb heartbeat
+
+	client := http.Client{Timeout: heartbeatInterval()}
+	resp, err := client.Get("http://" + addr + "/cluster/heartbeat")
+	if err != nil {
+		return hb, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return hb, fmt.Errorf("heartbeat failed: %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&hb)
+	return hb, err
+}
+
+func nodeIndex(addr string) int {
+	for i, replica := range Config.Replicas {
+		if replica == addr {
+			return i
+		}
+	}
+	return len(Config.Replicas)
+}
+
+// discoverPrimary asks the other nodes whether one of them already acts as primary, used at startup
+// so that a restarted node does not claim a role that has moved on in the meantime
+func discoverPrimary() (string, uint64, bool) {
+	found, foundTerm := "", uint64(0)
+	for _, addr := range Config.Replicas {
+		if addr == SelfAddr {
+			continue
+		}
+		hb, err := fetchHeartbeat(addr)
+		if err != nil || !hb.IsPrimary {
+			continue
+		}
+		if hb.Term > foundTerm || (hb.Term == foundTerm && nodeIndex(hb.Node) < nodeIndex(found)) {
+			found, foundTerm = hb.Node, hb.Term
+		}
+	}
+	return found, foundTerm, found != ""
+}
+
+func sendHeartbeats() {
+	for {
+		time.Sleep(heartbeatInterval())
+
+		var wg sync.WaitGroup
+		for _, addr := range Config.Replicas {
+			if addr == SelfAddr {
+				continue
+			}
+			wg.Add(1)
+			go func(addr string) {
+				defer wg.Done()
+				hb, err := fetchHeartbeat(addr)
+				if err != nil {
+					return
+				}
+				clusterMu.Lock()
+				peers[addr] = &peerState{lastSeen: time.Now(), hb: hb}
+				clusterMu.Unlock()
+				observeHeartbeat(hb)
+			}(addr)
+		}
+		wg.Wait()
+
+		checkPrimary()
+	}
+}
+
+// observeHeartbeat reacts to what a peer reports about itself
+func observeHeartbeat(hb heartbeat) {
+	clusterMu.Lock()
+	follow := false
+	if hb.IsPrimary && hb.Node != CurrentPrimary {
+		if hb.Term > term {
+			follow = true
+		} else if hb.Term == term && nodeIndex(hb.Node) < nodeIndex(CurrentPrimary) {
+			// two primaries in the same term, the lower index wins
+			follow = true
+		}
+	}
+	fromPrimary := hb.Node == CurrentPrimary && !isPrimary
+	clusterMu.Unlock()
+
+	if follow {
+		followPrimary(hb.Node, hb.Term)
+		return
+	}
+	if fromPrimary {
+		notePrimarySeq(hb.LastSeq)
+		checkProgress(hb)
+	}
+}
+
+// checkProgress compares our applied sequence number with the primary's and catches up when we stay behind
+func checkProgress(hb heartbeat) {
+	MemosMu.Lock()
+	applied := LastSeq
+	isReady := Ready
+	MemosMu.Unlock()
+
+	if !isReady {
+		return
+	}
+
+	if applied > hb.LastSeq {
+		// we applied entries the primary does not have, start over from its snapshot
+		fmt.Printf("[2023 %s] %s SERVER [DIVERGED]       applied %d but primary is at %d\n", time.Now().Format(time.StampNano), Role, applied, hb.LastSeq)
+		err := installSnapshot()
+		if err != nil {
+			log.Printf("Resync from the primary failed: %s\n", err)
+		}
+		return
+	}
+
+	clusterMu.Lock()
+	if applied == hb.LastSeq {
+		behindSince = time.Time{}
+		clusterMu.Unlock()
+		return
+	}
+	if behindSince.IsZero() {
+		behindSince = time.Now()
+		clusterMu.Unlock()
+		return
+	}
+	stale := time.Since(behindSince) > heartbeatInterval()
+	clusterMu.Unlock()
+
+	if stale {
+		// updates we missed, for example while the new primary had no queue for us
+		err := fetchLog(applied + 1)
+		if err != nil {
+			log.Printf("Failed to fetch missing entries from seq %d: %s\n", applied+1, err)
+		}
+		clusterMu.Lock()
+		behindSince = time.Time{}
+		clusterMu.Unlock()
+	}
+}
+
+// checkPrimary starts a failover when the primary has been silent for longer than the timeout
+func checkPrimary() {
+	clusterMu.Lock()
+	if isPrimary || CurrentPrimary == "" {
+		clusterMu.Unlock()
+		return
+	}
+
+	lastSeen := startedAt
+	if p, ok := peers[CurrentPrimary]; ok {
+		lastSeen = p.lastSeen
+	}
+	if time.Since(lastSeen) < failoverTimeout() {
+		clusterMu.Unlock()
+		return
+	}
+
+	failed := CurrentPrimary
+	best, bestSeq := "", uint64(0)
+	if nodeReady {
+		best, bestSeq = SelfAddr, nodeSeq
+	}
+	for addr, p := range peers {
+		if addr == failed || !p.hb.Ready || time.Since(p.lastSeen) >= failoverTimeout() {
+			continue
+		}
+		if best == "" || p.hb.LastSeq > bestSeq || (p.hb.LastSeq == bestSeq && nodeIndex(addr) < nodeIndex(best)) {
+			best, bestSeq = addr, p.hb.LastSeq
+		}
+	}
+	clusterMu.Unlock()
+
+	if best == "" {
+		return
+	}
+
+	fmt.Printf("[2023 %s] %s SERVER [FAILOVER]       primary [%s] silent for %s, candidate [%s] at seq %d\n", time.Now().Format(time.StampNano), Role, failed, time.Since(lastSeen).Round(time.Millisecond), best, bestSeq)
+	if best == SelfAddr {
+		// the old primary may still hold a lease this node granted it
+		if owner, promised := promisedElsewhere(); leasesEnabled() && promised {
+			fmt.Printf("[2023 %s] %s SERVER [FAILOVER]       waiting for the lease granted to [%s] to expire\n", time.Now().Format(time.StampNano), Role, owner)
+			return
+		}
+		promote()
+	}
+}
+
+// promote makes this node the primary for the next term and tells everyone else
+func promote() {
+	MemosMu.Lock()
+	clusterMu.Lock()
+	isPrimary = true
+	CurrentPrimary = SelfAddr
+	term++
+	newTerm := term
+	clusterMu.Unlock()
+	// entries buffered from the old primary will never be completed
+	PendingEntries = make(map[uint64]LogEntry)
+	for _, memo := range AllMemos() {
+		if memo.ID > IDCount {
+			IDCount = memo.ID
+		}
+	}
+	MemosMu.Unlock()
+
+	fmt.Printf("[2023 %s] %s SERVER [PROMOTED]       now primary for term %d\n", time.Now().Format(time.StampNano), Role, newTerm)
+	announcing.Add(1)
+	go func() {
+		defer announcing.Done()
+		announcePrimary(newTerm)
+	}()
+}
+
+func announcePrimary(newTerm uint64) {
+	data, _ := json.Marshal(map[string]interface{}{
+		"primary": SelfAddr,
+		"term":    newTerm,
+	})
+
+	for _, addr := range Config.Replicas {
+		if addr == SelfAddr {
+			continue
+		}
+		resp, err := ReplicationClient.Post("http://"+addr+"/cluster/primary", "application/json", bytes.NewReader(data))
+		if err != nil {
+			// the node is down, it learns about us from heartbeats once it is back
+			continue
+		}
+		ObserveRejection(resp)
+		resp.Body.Close()
+	}
+}
+
+// followPrimary switches this node to a new primary, stepping down first if we were primary ourselves
+func followPrimary(primary string, newTerm uint64) {
+	MemosMu.Lock()
+	clusterMu.Lock()
+	if newTerm < term || primary == SelfAddr {
+		clusterMu.Unlock()
+		MemosMu.Unlock()
+		return
+	}
+	wasPrimary := isPrimary
+	if wasPrimary {
+		stepDowns++
+	}
+	isPrimary = false
+	CurrentPrimary = primary
+	term = newTerm
+	behindSince = time.Time{}
+	primarySeqSeen = 0
+	clusterMu.Unlock()
+
+	PendingEntries = make(map[uint64]LogEntry)
+	if wasPrimary {
+		// writes we accepted after losing the role are not on the new primary, start over from its state
+		Ready = false
+		publishProgress()
+	}
+	MemosMu.Unlock()
+
+	if wasPrimary {
+		fmt.Printf("[2023 %s] %s SERVER [DEMOTED]        [%s] is primary for term %d, rejoining as replica\n", time.Now().Format(time.StampNano), Role, primary, newTerm)
+		go catchUp()
+	} else {
+		fmt.Printf("[2023 %s] %s SERVER [NEW PRIMARY]    [%s] is primary for term %d\n", time.Now().Format(time.StampNano), Role, primary, newTerm)
+	}
+}
+
+// handleAnnounce accepts the announcement of a newly promoted primary
+func handleAnnounce(w http.ResponseWriter, r *http.Request) {
+	var announce struct {
+		Primary string `json:"primary"`
+		Term    uint64 `json:"term"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&announce)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	clusterMu.Lock()
+	ourTerm := term
+	primary := CurrentPrimary
+	if announce.Term < ourTerm {
+		rejectedStaleEpoch++
+	}
+	clusterMu.Unlock()
+
+	if announce.Term < ourTerm {
+		fmt.Printf("[2023 %s] %s SERVER [FENCED]         [%s] announced stale term %d, current epoch %d\n", time.Now().Format(time.StampNano), Role, announce.Primary, announce.Term, ourTerm)
+		fenceReply(w, ourTerm, primary, "Stale term")
+		return
+	}
+
+	followPrimary(announce.Primary, announce.Term)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(`{"msg": "OK"}`))
+}
@@ -0,0 +1,56 @@
+package node
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestFailoverShippedConfig loads the config.json the servers ship with, lets the primary fall silent and
+// checks that the replica takes over and then serves clients instead of refusing them for want of a lease
+func TestFailoverShippedConfig(t *testing.T) {
+	LoadConfig("../node1/config.json", 0)
+	LoadConfig("../node2/config.json", 1)
+
+	// the old primary never sends a heartbeat, it only takes the announcement of the new one
+	var announced int32
+	oldPrimary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/cluster/primary" {
+			atomic.AddInt32(&announced, 1)
+		}
+	}))
+	defer oldPrimary.Close()
+	Config.Replicas[0] = oldPrimary.Listener.Addr().String()
+
+	MemoStore = &memoryStore{}
+	LastSeq, Ready = 0, true
+	clusterMu.Lock()
+	CurrentPrimary, isPrimary, term = Config.Replicas[0], false, 1
+	peers = make(map[string]*peerState)
+	startedAt = time.Now()
+	clusterMu.Unlock()
+	publishProgress()
+
+	deadline := time.Now().Add(failoverTimeout() + 2*time.Second)
+	for !AmPrimary() && time.Now().Before(deadline) {
+		checkPrimary()
+		time.Sleep(heartbeatInterval() / 5)
+	}
+	announcing.Wait()
+	if !AmPrimary() {
+		t.Fatalf("%s did not take over within %s", SelfAddr, failoverTimeout())
+	}
+	if atomic.LoadInt32(&announced) != 1 {
+		t.Fatalf("the old primary got %d announcements, expected 1", announced)
+	}
+
+	if leasesEnabled() {
+		requestLease()
+	}
+	w := httptest.NewRecorder()
+	if RequireLease(w, httptest.NewRequest(http.MethodPost, "/note", nil)) {
+		t.Fatalf("the new primary refused a client write: %d %s", w.Code, w.Body.String())
+	}
+}
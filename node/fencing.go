@@ -0,0 +1,127 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/*
+	Epoch fencing
+
+	The failover term is the primary epoch. Every replication request carries it in Primary-Epoch together
+	with the sender in Primary-Node. Updates from an older epoch are rejected with 409 and the current epoch
+	in X-Primary-Epoch, and a primary that is told about a newer epoch steps down instead of taking more
+	client writes.
+*/
+
+var (
+	rejectedStaleEpoch uint64
+	rejectedNoEpoch    uint64
+	stepDowns          uint64
+)
+
+func currentEpoch() uint64 {
+	clusterMu.Lock()
+	defer clusterMu.Unlock()
+	return term
+}
+
+func SetEpochHeaders(req *http.Request) {
+	clusterMu.Lock()
+	epoch, primary := term, CurrentPrimary
+	clusterMu.Unlock()
+	req.Header.Set("Primary-Epoch", strconv.FormatUint(epoch, 10))
+	req.Header.Set("Primary-Node", primary)
+}
+
+func fenceReply(w http.ResponseWriter, epoch uint64, primary string, message string) {
+	w.Header().Set("X-Primary-Epoch", strconv.FormatUint(epoch, 10))
+	w.Header().Set("X-Primary-Node", primary)
+	http.Error(w, message, http.StatusConflict)
+}
+
+// checkEpoch accepts a replication request only from the primary of the current or a newer epoch,
+// a rejected request has already been answered when it returns false
+func checkEpoch(w http.ResponseWriter, r *http.Request) bool {
+	sender := r.Header.Get("Primary-Node")
+	epoch, err := strconv.ParseUint(r.Header.Get("Primary-Epoch"), 10, 64)
+
+	clusterMu.Lock()
+	ourEpoch := term
+	primary := CurrentPrimary
+	if err != nil {
+		rejectedNoEpoch++
+		clusterMu.Unlock()
+		fmt.Printf("[2023 %s] %s SERVER [FENCED]         [METHOD: %s] update from [%s] without epoch rejected\n", time.Now().Format(time.StampNano), Role, r.Method, sender)
+		fenceReply(w, ourEpoch, primary, "Missing Primary-Epoch")
+		return false
+	}
+	if epoch < ourEpoch || (epoch == ourEpoch && sender != primary) {
+		rejectedStaleEpoch++
+		clusterMu.Unlock()
+		fmt.Printf("[2023 %s] %s SERVER [FENCED]         [METHOD: %s] update from [%s] epoch %d rejected, current epoch %d\n", time.Now().Format(time.StampNano), Role, r.Method, sender, epoch, ourEpoch)
+		fenceReply(w, ourEpoch, primary, "Stale primary epoch")
+		return false
+	}
+	clusterMu.Unlock()
+
+	if epoch > ourEpoch {
+		followPrimary(sender, epoch)
+	}
+	return true
+}
+
+// ObserveRejection steps down when another node reports a newer epoch than ours
+func ObserveRejection(resp *http.Response) {
+	if resp.StatusCode != http.StatusConflict {
+		return
+	}
+	epoch, err := strconv.ParseUint(resp.Header.Get("X-Primary-Epoch"), 10, 64)
+	if err != nil || epoch <= currentEpoch() {
+		return
+	}
+
+	fmt.Printf("[2023 %s] %s SERVER [FENCED]         epoch %d exists, stepping down\n", time.Now().Format(time.StampNano), Role, epoch)
+	// the write that got rejected may still hold memosMu, followPrimary takes it itself
+	go followPrimary(resp.Header.Get("X-Primary-Node"), epoch)
+}
+
+// checkResponseEpoch refuses log entries and snapshots served by a primary of an older epoch
+func checkResponseEpoch(resp *http.Response) error {
+	epoch, err := strconv.ParseUint(resp.Header.Get("X-Primary-Epoch"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("response without primary epoch")
+	}
+	if ourEpoch := currentEpoch(); epoch < ourEpoch {
+		clusterMu.Lock()
+		rejectedStaleEpoch++
+		clusterMu.Unlock()
+		return fmt.Errorf("response from epoch %d, current epoch is %d", epoch, ourEpoch)
+	}
+	return nil
+}
+
+// fencingStatus reports the current epoch and how many updates were rejected
+func fencingStatus(w http.ResponseWriter, r *http.Request) {
+	clusterMu.Lock()
+	response, err := json.Marshal(map[string]interface{}{
+		"epoch":              term,
+		"primary":            CurrentPrimary,
+		"isPrimary":          isPrimary,
+		"rejectedStaleEpoch": rejectedStaleEpoch,
+		"rejectedNoEpoch":    rejectedNoEpoch,
+		"stepDowns":          stepDowns,
+	})
+	clusterMu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(response)
+}
@@ -0,0 +1,129 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Idempotency keys
+
+	A write that carries an Idempotency-Key header is remembered under that key for idempotencyWindowMs
+	(10 minutes by default). A retry with the same key gets the stored response back with
+	Idempotent-Replay: true instead of being applied again, whether it reaches the primary directly or
+	through a replica, and a retry that arrives while the first request is still running waits for it.
+	The key travels with the update to the replicas and in snapshots, so a new primary still knows it
+	after a failover. Keys are kept by the modes that have a primary or a Raft leader.
+*/
+
+// idempotentResult is the response remembered for a key
+type idempotentResult struct {
+	Scope   string    `json:"scope"` // method and path the key was used for
+	Status  int       `json:"status"`
+	ETag    string    `json:"etag,omitempty"`
+	Body    []byte    `json:"body"`
+	Expires time.Time `json:"expires"`
+}
+
+var (
+	idempotencyKeys = make(map[string]idempotentResult) // guarded by memosMu
+	keysSweptAt     time.Time
+	inFlightMu      sync.Mutex
+	inFlight        = make(map[string]chan struct{})
+)
+
+func idempotencyWindow() time.Duration {
+	if Config.IdempotencyWindowMs <= 0 {
+		return 10 * time.Minute
+	}
+	return time.Duration(Config.IdempotencyWindowMs) * time.Millisecond
+}
+
+func keyScope(method string, id int) string {
+	if method == http.MethodPost {
+		return "POST /note"
+	}
+	return fmt.Sprintf("%s /note/%d", method, id)
+}
+
+// rememberKey stores the result of an applied write under its key, must be called with memosMu held
+func rememberKey(key string, method string, id int) {
+	if key == "" {
+		return
+	}
+	now := time.Now()
+	if now.Sub(keysSweptAt) > idempotencyWindow()/10 {
+		for k, res := range idempotencyKeys {
+			if now.After(res.Expires) {
+				delete(idempotencyKeys, k)
+			}
+		}
+		keysSweptAt = now
+	}
+
+	res := idempotentResult{Scope: keyScope(method, id), Status: http.StatusOK, Body: []byte(`{"msg": "OK"}`), Expires: now.Add(idempotencyWindow())}
+	if method == http.MethodPost {
+		res.Status = http.StatusCreated
+	}
+	if memo, ok := GetMemo(id); ok && method != http.MethodDelete {
+		res.Body, _ = json.Marshal(memo)
+		res.ETag = memoETag(memo)
+	}
+	idempotencyKeys[key] = res
+}
+
+// IdempotencyGuard answers a retried write from the stored result, otherwise the caller runs the write and
+// calls done once it is finished
+func IdempotencyGuard(w http.ResponseWriter, r *http.Request) (func(), bool) {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" || r.Method == http.MethodGet {
+		return func() {}, false
+	}
+
+	var running chan struct{}
+	for {
+		inFlightMu.Lock()
+		other, busy := inFlight[key]
+		if !busy {
+			running = make(chan struct{})
+			inFlight[key] = running
+			inFlightMu.Unlock()
+			break
+		}
+		inFlightMu.Unlock()
+		<-other
+	}
+	done := func() {
+		inFlightMu.Lock()
+		delete(inFlight, key)
+		inFlightMu.Unlock()
+		close(running)
+	}
+
+	MemosMu.Lock()
+	res, ok := idempotencyKeys[key]
+	MemosMu.Unlock()
+	if !ok || time.Now().After(res.Expires) {
+		return done, false
+	}
+	done()
+
+	scope := r.Method + " " + strings.TrimSuffix(r.URL.Path, "/")
+	if scope != res.Scope {
+		http.Error(w, fmt.Sprintf("Idempotency-Key was used for %s", res.Scope), http.StatusUnprocessableEntity)
+		return nil, true
+	}
+	if res.ETag != "" {
+		w.Header().Set("ETag", res.ETag)
+	}
+	w.Header().Set("Idempotent-Replay", "true")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(res.Status)
+	_, _ = w.Write(res.Body)
+	fmt.Printf("[2023 %s] %s SERVER [IDEMPOTENT]     [METHOD: %s] key %s replayed\n", time.Now().Format(time.StampNano), Role, r.Method, key)
+	return nil, true
+}
@@ -0,0 +1,187 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+	Primary lease
+
+	With leaseMs set the primary serves client requests only while it holds a lease. Every heartbeat
+	interval it asks the other nodes to grant it for leaseMs. A node that granted the lease promises not to
+	grant one to any other node until leaseMs after it received the request, and the primary counts its
+	lease from before it sent the request, minus a margin for clock drift, once a majority of the nodes
+	granted it. Two primaries therefore never hold a lease at the same time: a newly promoted primary gets
+	its own only after the promises made to the old one have expired, and until then answers with 503.
+	Leases need at least three nodes: with two, the majority is both of them and a primary that fails takes
+	the lease of its successor down with it.
+*/
+
+var (
+	leaseMu       sync.Mutex
+	leaseUntil    time.Time // this node holds the lease until then
+	promisedTo    string    // node this node last granted the lease to
+	promisedUntil time.Time // no other node gets the lease before then
+	leaseRenewals uint64
+	leaseDenied   uint64
+)
+
+func leaseDuration() time.Duration {
+	return time.Duration(Config.LeaseMs) * time.Millisecond
+}
+
+// leasesEnabled reports whether client requests need a lease, modes without a single primary never do
+func leasesEnabled() bool {
+	return Config.LeaseMs > 0 && Config.Sync != "local-write" && Config.Sync != "quorum" && Config.Sync != "raft" && Config.Sync != "multi-primary"
+}
+
+func remainingUntil(t time.Time) time.Duration {
+	if remaining := time.Until(t); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+func leaseRemaining() time.Duration {
+	leaseMu.Lock()
+	defer leaseMu.Unlock()
+	return remainingUntil(leaseUntil)
+}
+
+// promisedElsewhere reports whether this node still promised the lease to another node
+func promisedElsewhere() (string, bool) {
+	leaseMu.Lock()
+	defer leaseMu.Unlock()
+	return promisedTo, promisedTo != SelfAddr && time.Now().Before(promisedUntil)
+}
+
+// handleLease grants the lease to the primary named in Primary-Node
+func handleLease(w http.ResponseWriter, r *http.Request) {
+	if !checkEpoch(w, r) {
+		return
+	}
+	holder := r.Header.Get("Primary-Node")
+
+	leaseMu.Lock()
+	if promisedTo != holder && time.Now().Before(promisedUntil) {
+		owner, remaining := promisedTo, time.Until(promisedUntil)
+		leaseDenied++
+		leaseMu.Unlock()
+		fmt.Printf("[2023 %s] %s SERVER [LEASE]          denied to [%s], promised to [%s] for another %s\n", time.Now().Format(time.StampNano), Role, holder, owner, remaining.Round(time.Millisecond))
+		http.Error(w, fmt.Sprintf("Lease promised to %s", owner), http.StatusConflict)
+		return
+	}
+	promisedTo = holder
+	promisedUntil = time.Now().Add(leaseDuration())
+	leaseMu.Unlock()
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// renewLease runs on every node and asks for the lease whenever this node is the primary
+func renewLease() {
+	for {
+		if AmPrimary() {
+			requestLease()
+		}
+		time.Sleep(heartbeatInterval())
+	}
+}
+
+// requestLease asks every other node to grant this node the lease and takes it once a majority did
+func requestLease() {
+	start := time.Now()
+	granted := 0
+	// our own promise to a previous primary holds for us as well
+	if _, promised := promisedElsewhere(); !promised {
+		granted = 1
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	client := http.Client{Timeout: heartbeatInterval()}
+	for _, addr := range Config.Replicas {
+		if addr == SelfAddr {
+			continue
+		}
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			req, err := http.NewRequest(http.MethodPost, "http://"+addr+"/cluster/lease", nil)
+			if err != nil {
+				return
+			}
+			SetEpochHeaders(req)
+			resp, err := client.Do(req)
+			if err != nil {
+				return
+			}
+			defer resp.Body.Close()
+			ObserveRejection(resp)
+			if resp.StatusCode == http.StatusOK {
+				mu.Lock()
+				granted++
+				mu.Unlock()
+			}
+		}(addr)
+	}
+	wg.Wait()
+
+	if granted >= len(Config.Replicas)/2+1 && AmPrimary() {
+		leaseMu.Lock()
+		wasValid := time.Now().Before(leaseUntil)
+		leaseUntil = start.Add(leaseDuration() - leaseDuration()/10)
+		leaseRenewals++
+		leaseMu.Unlock()
+		if !wasValid {
+			fmt.Printf("[2023 %s] %s SERVER [LEASE]          acquired, granted by %d of %d nodes\n", time.Now().Format(time.StampNano), Role, granted, len(Config.Replicas))
+		}
+	}
+}
+
+// RequireLease answers with 503 when this node acts as primary without a valid lease
+func RequireLease(w http.ResponseWriter, r *http.Request) bool {
+	if !leasesEnabled() || !AmPrimary() {
+		return false
+	}
+	remaining := leaseRemaining()
+	w.Header().Set("X-Lease-Remaining", strconv.FormatInt(remaining.Milliseconds(), 10))
+	if remaining > 0 {
+		return false
+	}
+
+	fmt.Printf("[2023 %s] %s SERVER [LEASE]          [METHOD: %s] refused, no valid lease\n", time.Now().Format(time.StampNano), Role, r.Method)
+	w.Header().Set("Retry-After", strconv.Itoa(int(heartbeatInterval()/time.Second)+1))
+	http.Error(w, "Primary lease expired", http.StatusServiceUnavailable)
+	return true
+}
+
+// leaseStatus reports the lease this node holds and the promise it made
+func leaseStatus(w http.ResponseWriter, r *http.Request) {
+	leaseMu.Lock()
+	status := map[string]interface{}{
+		"enabled":       leasesEnabled(),
+		"leaseMs":       Config.LeaseMs,
+		"validForMs":    remainingUntil(leaseUntil).Milliseconds(),
+		"promisedTo":    promisedTo,
+		"promisedForMs": remainingUntil(promisedUntil).Milliseconds(),
+		"renewals":      leaseRenewals,
+		"denied":        leaseDenied,
+	}
+	leaseMu.Unlock()
+	status["isPrimary"] = AmPrimary()
+	response, err := json.Marshal(status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(response)
+}
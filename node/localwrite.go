@@ -0,0 +1,502 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+	Local-Write protocol ("sync": "local-write")
+
+	Every memo has an owner, the node that is currently primary for it (Replicas[0] until someone else writes it).
+	A node receiving a client write first takes the item over from its owner (/handover/{id}), applies the write
+	locally and then pushes the new state and the new owner to every other node (/owner-update/{id}).
+	Reads are served locally by every node. A deleted memo leaves a tombstone with its last version, so an
+	update from before the delete that arrives late, for example from an outbox, cannot bring it back.
+*/
+
+var (
+	owners  = make(map[int]string) // memo ID -> address of the node that is primary for it
+	writeMu sync.Mutex             // serializes local writes and handovers on this node
+)
+
+// buryMemo removes a memo and keeps it as a tombstone, must be called with memosMu held
+func buryMemo(memo Memo) {
+	removeMemo(memo.ID)
+	delete(owners, memo.ID)
+	if deleted, ok := tombstones[memo.ID]; !ok || memo.Version > deleted.Version {
+		tombstones[memo.ID] = memo
+	}
+}
+
+// ownerOf must be called with memosMu held
+func ownerOf(id int) string {
+	if owner, ok := owners[id]; ok {
+		return owner
+	}
+	return Config.Replicas[0]
+}
+
+// sameMemo compares two memos, Memo cannot be compared with == since it carries a vector clock
+func sameMemo(a, b Memo) bool {
+	return reflect.DeepEqual(a, b)
+}
+
+// upsertMemo must be called with memosMu held
+func upsertMemo(newMemo Memo) {
+	err := MemoStore.Put(newMemo)
+	if err != nil {
+		storeFailed(err)
+	}
+}
+
+// removeMemo must be called with memosMu held
+func removeMemo(id int) bool {
+	ok, err := MemoStore.Delete(id)
+	if err != nil {
+		storeFailed(err)
+	}
+	return ok
+}
+
+// requestHandover asks the current owner of a memo to hand it over to this node
+func requestHandover(owner string, id int) (Memo, bool, error) {
+	var memo Memo
+
+	for attempt := 1; attempt <= 5; attempt++ {
+		url := fmt.Sprintf("http://%s/handover/%d", owner, id)
+		fmt.Printf("[2023 %s] %s SERVER [HANDOVER]       [ID: %d] Request to [%s]\n", time.Now().Format(time.StampNano), Role, id, url)
+
+		req, err := http.NewRequest(http.MethodPost, url, nil)
+		if err != nil {
+			return memo, false, err
+		}
+		req.Header.Set("New-Owner", SelfAddr)
+
+		resp, err := ReplicationClient.Do(req)
+		if err != nil {
+			return memo, false, err
+		}
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+			err = json.NewDecoder(resp.Body).Decode(&memo)
+			resp.Body.Close()
+			return memo, err == nil, err
+		case http.StatusNotFound:
+			resp.Body.Close()
+			return memo, false, nil
+		case http.StatusConflict:
+			// our view of the owner was stale, follow the node it points to
+			owner = resp.Header.Get("Item-Owner")
+			resp.Body.Close()
+			if owner == SelfAddr {
+				return memo, false, fmt.Errorf("handover of memo %d looped back to this node", id)
+			}
+		case http.StatusServiceUnavailable:
+			// the owner is in the middle of its own write, try again shortly
+			resp.Body.Close()
+			time.Sleep(time.Duration(attempt*50) * time.Millisecond)
+		default:
+			resp.Body.Close()
+			return memo, false, fmt.Errorf("handover of memo %d failed: %s", id, resp.Status)
+		}
+	}
+
+	return memo, false, fmt.Errorf("handover of memo %d did not complete", id)
+}
+
+// handOver gives up ownership of a memo to the node named in the New-Owner header
+func handOver(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	newOwner := r.Header.Get("New-Owner")
+	if newOwner == "" {
+		http.Error(w, "Missing New-Owner header", http.StatusBadRequest)
+		return
+	}
+
+	if !writeMu.TryLock() {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Write in progress", http.StatusServiceUnavailable)
+		return
+	}
+	defer writeMu.Unlock()
+
+	MemosMu.Lock()
+	defer MemosMu.Unlock()
+
+	if owner := ownerOf(id); owner != SelfAddr {
+		w.Header().Set("Item-Owner", owner)
+		http.Error(w, "Not the owner of this memo", http.StatusConflict)
+		return
+	}
+
+	memo, ok := GetMemo(id)
+	if !ok {
+		delete(owners, id)
+		http.Error(w, "Memo not found", http.StatusNotFound)
+		return
+	}
+
+	response, err := json.Marshal(memo)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	owners[id] = newOwner
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(response)
+	fmt.Printf("[2023 %s] %s SERVER [HANDOVER]       [ID: %d] Handed over to [%s]\n", time.Now().Format(time.StampNano), Role, id, newOwner)
+}
+
+// applyOwnerUpdate stores the state pushed by the owner of a memo and remembers who the owner is
+func applyOwnerUpdate(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	// a PUT carries the new state, a DELETE the memo as it was deleted
+	var newMemo Memo
+	err = json.NewDecoder(r.Body).Decode(&newMemo)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	newMemo.ID = id
+
+	MemosMu.Lock()
+	if r.Method == http.MethodPut {
+		// updates from an owner can overtake each other, an older version never replaces a newer one
+		if memo, ok := GetMemo(id); ok && memo.Version > newMemo.Version {
+			MemosMu.Unlock()
+			PreconditionFailed(w, r, memo)
+			return
+		}
+		if deleted, ok := tombstones[id]; ok && newMemo.Version <= deleted.Version {
+			MemosMu.Unlock()
+			http.Error(w, fmt.Sprintf("Memo %d was deleted at version %d", id, deleted.Version), http.StatusPreconditionFailed)
+			return
+		}
+		upsertMemo(newMemo)
+		owners[id] = r.Header.Get("New-Owner")
+	} else {
+		buryMemo(newMemo)
+	}
+	MemosMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(`{"msg": "OK"}`))
+	fmt.Printf("[2023 %s] %s SERVER [OWNER UPDATE]   [METHOD: %s] [ID: %d] Owner [%s]\n", time.Now().Format(time.StampNano), Role, r.Method, id, r.Header.Get("New-Owner"))
+}
+
+// propagateOwnerUpdate pushes the new state of a memo to every other node in parallel, a node that does not
+// acknowledge it gets it again from its outbox
+func propagateOwnerUpdate(method string, newMemo Memo) []ReplicaResult {
+	var peers []string
+	for _, replica := range Config.Replicas {
+		if replica != SelfAddr {
+			peers = append(peers, replica)
+		}
+	}
+
+	update := ownerUpdate{Method: method, Memo: newMemo}
+	results := make([]ReplicaResult, len(peers))
+	var wg sync.WaitGroup
+	for i, peer := range peers {
+		wg.Add(1)
+		go func(i int, peer string) {
+			defer wg.Done()
+			results[i] = outboxFor(peer).deliver(update)
+		}(i, peer)
+	}
+	wg.Wait()
+
+	return results
+}
+
+/*
+	Propagation retries
+
+	Every peer has an outbox of the owner updates it did not acknowledge, holding the latest update per memo
+	since an update carries the whole state. A background worker per peer sends them again, backing off
+	exponentially while the peer is unreachable, until the peer acknowledges them or rejects them because
+	it already holds a newer version.
+*/
+
+type ownerUpdate struct {
+	Method string
+	Memo   Memo
+}
+
+type outbox struct {
+	peer    string
+	mu      sync.Mutex // held while sending, so a retry never overtakes a newer update to the same peer
+	pending map[int]ownerUpdate
+	wake    chan struct{}
+}
+
+var (
+	outboxes   = make(map[string]*outbox) // peer address -> updates it has not acknowledged
+	outboxesMu sync.Mutex
+)
+
+// outboxFor returns the outbox of a peer, starting its worker the first time
+func outboxFor(peer string) *outbox {
+	outboxesMu.Lock()
+	defer outboxesMu.Unlock()
+
+	o, ok := outboxes[peer]
+	if !ok {
+		o = &outbox{peer: peer, pending: make(map[int]ownerUpdate), wake: make(chan struct{}, 1)}
+		outboxes[peer] = o
+		go o.run()
+	}
+	return o
+}
+
+// deliver sends the update to the peer and leaves it in the outbox unless the peer acknowledged it
+func (o *outbox) deliver(update ownerUpdate) ReplicaResult {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	res := sendOwnerUpdate(o.peer, update)
+	if settled(res) {
+		// anything older still pending for this memo is superseded
+		delete(o.pending, update.Memo.ID)
+		return res
+	}
+
+	log.Printf("Failed to propagate %s of memo %d to %s, queued for retry\n", update.Method, update.Memo.ID, res.URL)
+	o.pending[update.Memo.ID] = update
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return res
+}
+
+// settled tells whether an update needs no retry, a 412 means the peer already holds a newer version
+func settled(res ReplicaResult) bool {
+	return res.Acked() || res.StatusCode == http.StatusPreconditionFailed
+}
+
+// retryOne sends one pending update again, it reports whether anything was pending and whether the peer
+// took it
+func (o *outbox) retryOne() (bool, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for id, update := range o.pending {
+		res := sendOwnerUpdate(o.peer, update)
+		if !settled(res) {
+			return true, false
+		}
+		delete(o.pending, id)
+		return true, true
+	}
+	return false, true
+}
+
+func (o *outbox) run() {
+	backoff := MinRetryBackoff
+	for range o.wake {
+		for {
+			found, delivered := o.retryOne()
+			if !found {
+				break
+			}
+			if delivered {
+				backoff = MinRetryBackoff
+				continue
+			}
+
+			fmt.Printf("[2023 %s] %s SERVER [RETRY QUEUE]    [%s] owner update failed, retrying in %s\n", time.Now().Format(time.StampNano), Role, o.peer, backoff)
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > MaxRetryBackoff {
+				backoff = MaxRetryBackoff
+			}
+		}
+	}
+}
+
+// sendOwnerUpdate pushes one update to /owner-update/{id} on a peer
+func sendOwnerUpdate(peer string, update ownerUpdate) ReplicaResult {
+	res := ReplicaResult{URL: fmt.Sprintf("http://%s/owner-update/%d", peer, update.Memo.ID)}
+
+	data, _ := json.Marshal(update.Memo)
+	req, err := http.NewRequest(update.Method, res.URL, bytes.NewReader(data))
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	req.Header.Set("New-Owner", SelfAddr)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := ReplicationClient.Do(req)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	resp.Body.Close()
+	res.StatusCode = resp.StatusCode
+	return res
+}
+
+// LocalWrite handles a client write in local-write mode, this node becomes the primary for the memo
+func LocalWrite(w http.ResponseWriter, r *http.Request) {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	if r.Method == http.MethodPost {
+		var newMemo Memo
+		err := json.NewDecoder(r.Body).Decode(&newMemo)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		LogRequest(r, "Received new memo with title: ", newMemo.Title)
+
+		// IDs are striped by node index so that nodes never hand out the same ID
+		MemosMu.Lock()
+		IDCount++
+		newMemo.ID = (IDCount-1)*len(Config.Replicas) + selfIndex + 1
+		newMemo.Version = 1
+		err = MemoStore.Create(newMemo)
+		if err != nil {
+			MemosMu.Unlock()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		owners[newMemo.ID] = SelfAddr
+		MemosMu.Unlock()
+
+		response, err := json.Marshal(newMemo)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		results := propagateOwnerUpdate(http.MethodPut, newMemo)
+		SetAckHeader(w, results)
+		SetETag(w, newMemo)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write(response)
+		fmt.Printf("[2023 %s] %s SERVER [REPLY]          [METHOD: %s] %s\n", time.Now().Format(time.StampNano), Role, r.Method, string(response))
+		return
+	}
+
+	LogRequest(r, "Received ", r.Method, " request")
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	var requestBody map[string]string
+	if r.Method == http.MethodPatch || r.Method == http.MethodPut {
+		err = json.NewDecoder(r.Body).Decode(&requestBody)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	MemosMu.Lock()
+	owner := ownerOf(id)
+	MemosMu.Unlock()
+
+	if owner != SelfAddr {
+		memo, found, err := requestHandover(owner, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if !found {
+			http.Error(w, "Memo not found", http.StatusNotFound)
+			return
+		}
+
+		MemosMu.Lock()
+		upsertMemo(memo)
+		owners[id] = SelfAddr
+		MemosMu.Unlock()
+		fmt.Printf("[2023 %s] %s SERVER [HANDOVER]       [ID: %d] Now primary for this memo\n", time.Now().Format(time.StampNano), Role, id)
+	}
+
+	MemosMu.Lock()
+	memo, ok := GetMemo(id)
+	if !ok {
+		MemosMu.Unlock()
+		http.Error(w, "Memo not found", http.StatusNotFound)
+		return
+	}
+	if !IfMatch(r, memo) {
+		MemosMu.Unlock()
+		PreconditionFailed(w, r, memo)
+		return
+	}
+
+	var newMemo Memo
+	if r.Method == http.MethodDelete {
+		newMemo = memo
+		buryMemo(memo)
+	} else {
+		if r.Method == http.MethodPut {
+			memo = Memo{ID: id, Version: memo.Version}
+		}
+		memo.Version++
+		if newBody, ok := requestBody["body"]; ok {
+			memo.Body = newBody
+		}
+		if newTitle, ok := requestBody["title"]; ok {
+			memo.Title = newTitle
+		}
+		upsertMemo(memo)
+		newMemo = memo
+	}
+	MemosMu.Unlock()
+
+	var response []byte
+	var results []ReplicaResult
+	if r.Method == http.MethodDelete {
+		response = []byte(`{"msg": "OK"}`)
+		results = propagateOwnerUpdate(http.MethodDelete, newMemo)
+	} else {
+		response, err = json.Marshal(newMemo)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		results = propagateOwnerUpdate(http.MethodPut, newMemo)
+		SetETag(w, newMemo)
+	}
+	SetAckHeader(w, results)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(response)
+	fmt.Printf("[2023 %s] %s SERVER [REPLY]          [METHOD: %s] %s\n", time.Now().Format(time.StampNano), Role, r.Method, string(response))
+}
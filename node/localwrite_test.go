@@ -0,0 +1,103 @@
+package node
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// TestOwnerUpdateRetry checks that an owner update a peer failed is sent again until the peer takes it
+func TestOwnerUpdateRetry(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, r.Method+" "+r.URL.Path)
+		if len(received) <= 2 {
+			http.Error(w, "not yet", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer peer.Close()
+
+	addr := strings.TrimPrefix(peer.URL, "http://")
+	Config = Configuration{Sync: "local-write", Replicas: []string{"127.0.0.1:1", addr}}
+	SelfAddr = Config.Replicas[0]
+
+	results := propagateOwnerUpdate(http.MethodPut, Memo{ID: 3, Title: "three", Version: 2})
+	if len(results) != 1 || results[0].Acked() {
+		t.Fatalf("first delivery returned %+v, expected one failed result", results)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		o := outboxFor(addr)
+		o.mu.Lock()
+		pending := len(o.pending)
+		o.mu.Unlock()
+		if pending == 0 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 3 {
+		t.Fatalf("peer received %v, expected the update three times", received)
+	}
+	for _, req := range received {
+		if req != "PUT /owner-update/3" {
+			t.Fatalf("peer received %q", req)
+		}
+	}
+}
+
+// TestDeleteTombstone checks that an owner update from before a delete cannot bring the memo back
+func TestDeleteTombstone(t *testing.T) {
+	Config = Configuration{Sync: "local-write", Replicas: []string{"127.0.0.1:1", "127.0.0.1:2"}}
+	SelfAddr = Config.Replicas[1]
+	MemoStore = &memoryStore{}
+	tombstones = make(map[int]Memo)
+	owners = make(map[int]string)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/owner-update/{id}", applyOwnerUpdate).Methods(http.MethodPut, http.MethodDelete)
+	send := func(method string, memo Memo) int {
+		data, _ := json.Marshal(memo)
+		req := httptest.NewRequest(method, "/owner-update/5", strings.NewReader(string(data)))
+		req.Header.Set("New-Owner", Config.Replicas[0])
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := send(http.MethodPut, Memo{ID: 5, Title: "five", Version: 1}); code != http.StatusOK {
+		t.Fatalf("PUT at version 1 returned %d", code)
+	}
+	if code := send(http.MethodDelete, Memo{ID: 5, Title: "five", Version: 2}); code != http.StatusOK {
+		t.Fatalf("DELETE at version 2 returned %d", code)
+	}
+
+	// the update that preceded the delete, retried late from an outbox
+	for _, version := range []uint64{1, 2} {
+		if code := send(http.MethodPut, Memo{ID: 5, Title: "stale", Version: version}); code != http.StatusPreconditionFailed {
+			t.Fatalf("delayed PUT at version %d returned %d, expected %d", version, code, http.StatusPreconditionFailed)
+		}
+	}
+
+	MemosMu.Lock()
+	memo, ok := GetMemo(5)
+	MemosMu.Unlock()
+	if ok {
+		t.Fatalf("deleted memo came back as %+v", memo)
+	}
+}
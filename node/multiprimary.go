@@ -0,0 +1,398 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+	Multi-primary mode ("sync": "multi-primary")
+
+	Every node accepts writes for every memo, also while it cannot reach the others. Each version of a memo
+	carries a vector clock with one counter per node that wrote to it, and a hybrid logical clock stamp of
+	the write. A node pushes its writes to the other nodes right away and pulls their versions every
+	anti-entropy interval. A version whose clock descends from ours replaces ours, one that is concurrent
+	with ours is a conflict and is resolved by conflictPolicy:
+
+		lww       the version with the later stamp wins, ties broken by the node that wrote it (default)
+		siblings  all concurrent versions are kept, the newest is returned with the others in "siblings"
+
+	A write on a node supersedes every version that node knows of, so a PUT after reading the siblings
+	resolves them. An edit concurrent with a delete keeps the memo visible.
+*/
+
+type vectorClock map[string]uint64
+
+// merge returns a clock that descends from both clocks
+func (vc vectorClock) merge(other vectorClock) vectorClock {
+	merged := make(vectorClock, len(vc))
+	for node, counter := range vc {
+		merged[node] = counter
+	}
+	for node, counter := range other {
+		if counter > merged[node] {
+			merged[node] = counter
+		}
+	}
+	return merged
+}
+
+// descends reports whether vc has seen every write that other has seen
+func (vc vectorClock) descends(other vectorClock) bool {
+	for node, counter := range other {
+		if vc[node] < counter {
+			return false
+		}
+	}
+	return true
+}
+
+var (
+	mpVersions  = make(map[int][]quorumRecord) // memo ID -> concurrent versions, deletes included
+	mpConflicts uint64
+	hlcMu       sync.Mutex
+	hlcLast     uint64 // wall clock milliseconds << 16 | logical counter
+)
+
+func conflictPolicy() string {
+	if Config.ConflictPolicy == "" {
+		return "lww"
+	}
+	return Config.ConflictPolicy
+}
+
+// hlcNow returns a stamp later than the wall clock and every stamp this node issued or received
+func hlcNow() uint64 {
+	hlcMu.Lock()
+	defer hlcMu.Unlock()
+	if wall := uint64(time.Now().UnixMilli()) << 16; wall > hlcLast {
+		hlcLast = wall
+	} else {
+		hlcLast++
+	}
+	return hlcLast
+}
+
+func hlcObserve(stamp uint64) {
+	hlcMu.Lock()
+	if stamp > hlcLast {
+		hlcLast = stamp
+	}
+	hlcMu.Unlock()
+}
+
+// laterWrite orders versions by their stamp and then by the node that wrote them
+func laterWrite(a, b Memo) bool {
+	if a.HLC != b.HLC {
+		return a.HLC > b.HLC
+	}
+	return a.VersionNode > b.VersionNode
+}
+
+// mpPublish updates the memo clients see from the stored versions, must be called with memosMu held
+func mpPublish(id int) {
+	var live []Memo
+	for _, version := range mpVersions[id] {
+		if !version.Deleted {
+			live = append(live, version.Memo)
+		}
+	}
+	if len(live) == 0 {
+		removeMemo(id)
+		return
+	}
+
+	sort.Slice(live, func(i, j int) bool { return laterWrite(live[i], live[j]) })
+	shown := live[0]
+	shown.Siblings = nil
+	if len(live) > 1 {
+		shown.Siblings = live[1:]
+	}
+	upsertMemo(shown)
+}
+
+// mpMerge adds a version written elsewhere, must be called with memosMu held
+func mpMerge(rec quorumRecord) bool {
+	id := rec.Memo.ID
+	rec.Memo.Siblings = nil
+	hlcObserve(rec.Memo.HLC)
+
+	// IDs from our own stripe may come back from a node that kept them while we restarted
+	observeStripeID(id)
+	if crdtEnabled() {
+		return mpMergeOps(rec)
+	}
+
+	var concurrent []quorumRecord
+	for _, version := range mpVersions[id] {
+		if version.Memo.Clock.descends(rec.Memo.Clock) {
+			return false
+		}
+		if !rec.Memo.Clock.descends(version.Memo.Clock) {
+			concurrent = append(concurrent, version)
+		}
+	}
+
+	if len(concurrent) > 0 {
+		mpConflicts++
+		fmt.Printf("[2023 %s] %s SERVER [CONFLICT]       memo %d written concurrently by [%s] and [%s], policy %s\n", time.Now().Format(time.StampNano), Role, id, rec.Memo.VersionNode, concurrent[0].Memo.VersionNode, conflictPolicy())
+		if conflictPolicy() == "lww" {
+			// the winner takes the losers' clocks along so that every node ends up with the same version
+			winner, clock := rec, rec.Memo.Clock
+			for _, version := range concurrent {
+				if laterWrite(version.Memo, winner.Memo) {
+					winner = version
+				}
+				clock = clock.merge(version.Memo.Clock)
+			}
+			winner.Memo.Clock = clock
+			rec, concurrent = winner, nil
+		}
+	}
+
+	mpVersions[id] = append(concurrent, rec)
+	mpPublish(id)
+	return true
+}
+
+// mpWrite stores a version written on this node, it supersedes every version we know of
+func mpWrite(rec quorumRecord) quorumRecord {
+	clock := vectorClock{}
+	for _, version := range mpVersions[rec.Memo.ID] {
+		clock = clock.merge(version.Memo.Clock)
+	}
+	clock[SelfAddr]++
+	rec.Memo.Clock = clock
+	rec.Memo.HLC = hlcNow()
+	rec.Memo.VersionNode = SelfAddr
+	rec.Memo.Siblings = nil
+	if !rec.Deleted {
+		rec.Ops = crdtEdit(rec.Memo.ID, 0, &rec.Memo.Title, &rec.Memo.Body)
+		if rec.Ops != nil {
+			crdtApply(rec.Memo.ID, rec.Ops)
+		}
+	}
+
+	stored := rec
+	stored.Ops = nil
+	mpVersions[rec.Memo.ID] = []quorumRecord{stored}
+	mpPublish(rec.Memo.ID)
+	return rec
+}
+
+// mpPush sends a local write to every other node, the ones that miss it pull it later
+func mpPush(rec quorumRecord) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	client := http.Client{Timeout: heartbeatInterval()}
+	for _, addr := range otherNodes() {
+		go func(addr string) {
+			resp, err := client.Post("http://"+addr+"/multi/update", "application/json", bytes.NewReader(data))
+			if err != nil {
+				fmt.Printf("[2023 %s] %s SERVER [MULTI PUSH]     memo %d to [%s] failed: %s\n", time.Now().Format(time.StampNano), Role, rec.Memo.ID, addr, err)
+				return
+			}
+			resp.Body.Close()
+		}(addr)
+	}
+}
+
+// handleMultiUpdate merges a version pushed by another node
+func handleMultiUpdate(w http.ResponseWriter, r *http.Request) {
+	var rec quorumRecord
+	if err := json.NewDecoder(r.Body).Decode(&rec); err != nil || rec.Memo.ID < 1 {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return
+	}
+
+	MemosMu.Lock()
+	mpMerge(rec)
+	MemosMu.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleMultiStore serves every version this node keeps, deletes included
+func handleMultiStore(w http.ResponseWriter, r *http.Request) {
+	MemosMu.Lock()
+	var versions []quorumRecord
+	for id, stored := range mpVersions {
+		for _, version := range stored {
+			// with CRDT memos a node catching up needs the whole document, not the last write's operations
+			if doc, ok := crdtDocs[id]; ok && crdtEnabled() {
+				version.Ops = doc.state()
+			}
+			versions = append(versions, version)
+		}
+	}
+	conflicts := mpConflicts
+	MemosMu.Unlock()
+
+	response, err := json.Marshal(versions)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Conflicts", strconv.FormatUint(conflicts, 10))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(response)
+}
+
+// runMultiSync pulls the versions of every other node, this is how a node catches up after it was cut off
+func runMultiSync() {
+	client := http.Client{Timeout: antiEntropyInterval()}
+	for {
+		time.Sleep(antiEntropyInterval())
+		for _, addr := range otherNodes() {
+			resp, err := client.Get("http://" + addr + "/multi/store")
+			if err != nil {
+				continue
+			}
+			var versions []quorumRecord
+			err = json.NewDecoder(resp.Body).Decode(&versions)
+			resp.Body.Close()
+			if err != nil {
+				continue
+			}
+
+			merged := 0
+			MemosMu.Lock()
+			for _, rec := range versions {
+				if mpMerge(rec) {
+					merged++
+				}
+			}
+			MemosMu.Unlock()
+			if merged > 0 {
+				fmt.Printf("[2023 %s] %s SERVER [MULTI SYNC]     merged %d versions from [%s]\n", time.Now().Format(time.StampNano), Role, merged, addr)
+			}
+		}
+	}
+}
+
+// MultiRequest serves a client request in multi-primary mode from this node's own copy
+func MultiRequest(w http.ResponseWriter, r *http.Request) {
+	LogRequest(r, "Received ", r.Method, " request")
+
+	idStr, hasID := mux.Vars(r)["id"]
+	if !hasID && r.Method == http.MethodGet {
+		MemosMu.Lock()
+		response, err := json.Marshal(AllMemos())
+		MemosMu.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(response)
+		return
+	}
+
+	if !hasID {
+		var newMemo Memo
+		err := json.NewDecoder(r.Body).Decode(&newMemo)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// IDs are striped by node index like in local-write mode, so nodes never collide
+		MemosMu.Lock()
+		IDCount++
+		newMemo.ID = (IDCount-1)*len(Config.Replicas) + selfIndex + 1
+		rec := mpWrite(quorumRecord{Memo: newMemo})
+		MemosMu.Unlock()
+
+		go mpPush(rec)
+		multiReply(w, rec, http.StatusCreated)
+		return
+	}
+
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	var requestBody map[string]string
+	if r.Method == http.MethodPatch || r.Method == http.MethodPut {
+		err = json.NewDecoder(r.Body).Decode(&requestBody)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	MemosMu.Lock()
+	current, found := GetMemo(id)
+	if !found {
+		MemosMu.Unlock()
+		http.Error(w, "Memo not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		MemosMu.Unlock()
+		w.Header().Set("X-Siblings", strconv.Itoa(len(current.Siblings)))
+		multiReply(w, quorumRecord{Memo: current}, http.StatusOK)
+		return
+	}
+
+	if !IfMatch(r, current) {
+		MemosMu.Unlock()
+		PreconditionFailed(w, r, current)
+		return
+	}
+
+	rec := quorumRecord{Memo: current}
+	switch r.Method {
+	case http.MethodDelete:
+		rec.Deleted = true
+	case http.MethodPut:
+		rec.Memo.Title = requestBody["title"]
+		rec.Memo.Body = requestBody["body"]
+	case http.MethodPatch:
+		if newBody, ok := requestBody["body"]; ok {
+			rec.Memo.Body = newBody
+		}
+		if newTitle, ok := requestBody["title"]; ok {
+			rec.Memo.Title = newTitle
+		}
+	}
+	resolved := len(current.Siblings)
+	rec = mpWrite(rec)
+	MemosMu.Unlock()
+
+	if resolved > 0 {
+		fmt.Printf("[2023 %s] %s SERVER [CONFLICT]       memo %d resolved, %d siblings superseded\n", time.Now().Format(time.StampNano), Role, id, resolved)
+	}
+	go mpPush(rec)
+	multiReply(w, rec, http.StatusOK)
+}
+
+func multiReply(w http.ResponseWriter, rec quorumRecord, status int) {
+	response := []byte(`{"msg": "OK"}`)
+	if !rec.Deleted {
+		var err error
+		response, err = json.Marshal(rec.Memo)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		SetETag(w, rec.Memo)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(response)
+}
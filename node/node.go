@@ -0,0 +1,78 @@
+/*
+node.go : Protocol code shared by the Primary and the Replica Server
+*/
+package node
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type Configuration struct {
+	ServicePort           int      `json:"servicePort"`
+	Sync                  string   `json:"sync"`
+	Replicas              []string `json:"replicas"`
+	Ack                   string   `json:"ack"`
+	HeartbeatIntervalMs   int      `json:"heartbeatIntervalMs"`
+	FailoverTimeoutMs     int      `json:"failoverTimeoutMs"`
+	ReplicationFactor     int      `json:"replicationFactor"`
+	WriteQuorum           int      `json:"writeQuorum"`
+	ReadQuorum            int      `json:"readQuorum"`
+	TxLog                 string   `json:"txLog"`
+	RaftLog               string   `json:"raftLog"`
+	AntiEntropyIntervalMs int      `json:"antiEntropyIntervalMs"`
+	ReadWaitTimeoutMs     int      `json:"readWaitTimeoutMs"`
+	LeaseMs               int      `json:"leaseMs"`
+	ConflictPolicy        string   `json:"conflictPolicy"`
+	CRDT                  bool     `json:"crdt"`
+	IdempotencyWindowMs   int      `json:"idempotencyWindowMs"`
+	WALDir                string   `json:"walDir"`
+	WALSync               string   `json:"walSync"`
+	WALSyncIntervalMs     int      `json:"walSyncIntervalMs"`
+	SnapshotIntervalMs    int      `json:"snapshotIntervalMs"`
+	SnapshotEntries       int      `json:"snapshotEntries"`
+	Store                 string   `json:"store"`
+	StoreDir              string   `json:"storeDir"`
+}
+
+type Memo struct {
+	ID          int         `json:"id"`
+	Title       string      `json:"title"`
+	Body        string      `json:"body"`
+	Version     uint64      `json:"version,omitempty"`     // raised by every write
+	VersionNode string      `json:"versionNode,omitempty"` // node that wrote Version or Clock
+	Clock       vectorClock `json:"clock,omitempty"`       // multi-primary mode only
+	HLC         uint64      `json:"hlc,omitempty"`         // stamp of the write in multi-primary mode
+	Siblings    []Memo      `json:"siblings,omitempty"`    // concurrent versions kept by the siblings policy
+}
+
+var (
+	MemosMu sync.Mutex
+	IDCount = 0
+
+	Config    Configuration
+	SelfAddr  string // this node's entry in config.Replicas
+	selfIndex int
+
+	Role = "Primary" // "Primary" or "Replica", every log line starts with it
+)
+
+func LogRequest(r *http.Request, args ...interface{}) {
+	message := fmt.Sprint(args...)
+	fmt.Printf("[2023 %s] %s SERVER [REQUEST]        [METHOD: %s] %s\n", time.Now().Format(time.StampNano), Role, r.Method, message)
+}
+
+type ReplicaResult struct {
+	URL        string
+	StatusCode int
+	Err        error
+	Mismatch   string // set when the replica held different data under the same memo ID
+	AppliedSeq uint64 // last sequence number the replica reported as applied
+	Confirmed  bool   // chain mode: the tail of the chain applied the entry
+}
+
+func (res ReplicaResult) Acked() bool {
+	return res.Err == nil && res.StatusCode >= 200 && res.StatusCode < 300
+}
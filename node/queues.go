@@ -0,0 +1,392 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+	Acknowledgement modes ("ack" in config.json)
+
+	sync      : reply after every replica acknowledged, otherwise 503 (default)
+	semi-sync : reply after the first replica acknowledged, the others finish in the background,
+	            503 when no replica acknowledged
+	async     : reply immediately, the update is delivered by the per-replica replication queues
+	quorum    : reply after a majority of all nodes, the primary included, stored the update; only
+	            chosen per request with X-Consistency: quorum
+
+	On 503 the write is already applied on the primary, the body carries the memo and the ack count
+	so the client can decide whether to retry. In every mode a replica that missed the update receives
+	it later from its replication queue. The primary and a replica promoted after a failover both
+	replicate through here.
+*/
+
+func AckMode() string {
+	if Config.Ack == "" {
+		return "sync"
+	}
+	return Config.Ack
+}
+
+// ackModeFor maps the X-Consistency level of a write onto an ack mode, without one the configured mode applies
+func ackModeFor(level string) string {
+	switch level {
+	case "one", "primary":
+		return "async"
+	case "quorum":
+		return "quorum"
+	case "all":
+		return "sync"
+	}
+	return AckMode()
+}
+
+// replicaAddrs returns every node in config.json except this one
+func replicaAddrs() []string {
+	var addrs []string
+	for _, replica := range Config.Replicas {
+		if replica != SelfAddr {
+			addrs = append(addrs, replica)
+		}
+	}
+	return addrs
+}
+
+// syncOne sends the update to a single replica
+func syncOne(addr string, entry LogEntry) ReplicaResult {
+	res := SendEntry(addr, entry)
+	logResult(entry, res)
+	if res.Acked() {
+		recordAck(addr, entry.Seq, res.AppliedSeq)
+	}
+	return res
+}
+
+func logResult(entry LogEntry, res ReplicaResult) {
+	if res.Mismatch != "" {
+		fmt.Printf("[2023 %s] %s SERVER [ID MISMATCH]    [METHOD: %s] [%s] memo %d %s on replica\n", time.Now().Format(time.StampNano), Role, entry.Method, res.URL, entry.Memo.ID, res.Mismatch)
+	}
+	if res.Acked() {
+		fmt.Printf("[2023 %s] %s SERVER [SYNC RESULT]    [METHOD: %s] [%s] ACK (%d)\n", time.Now().Format(time.StampNano), Role, entry.Method, res.URL, res.StatusCode)
+	} else if res.Err != nil {
+		fmt.Printf("[2023 %s] %s SERVER [SYNC RESULT]    [METHOD: %s] [%s] FAILED (%s)\n", time.Now().Format(time.StampNano), Role, entry.Method, res.URL, res.Err)
+	} else {
+		fmt.Printf("[2023 %s] %s SERVER [SYNC RESULT]    [METHOD: %s] [%s] FAILED (%d)\n", time.Now().Format(time.StampNano), Role, entry.Method, res.URL, res.StatusCode)
+	}
+}
+
+// ReplicateUpdate replicates an update according to the ack mode and reports whether the mode was satisfied
+func ReplicateUpdate(r *http.Request, entry LogEntry) (bool, []ReplicaResult) {
+	if Config.Sync == "chain" {
+		res, ok := ChainForward(entry)
+		if !ok {
+			// no live successor, the head is the tail as well
+			return true, nil
+		}
+		return res.Acked(), []ReplicaResult{res}
+	}
+
+	addrs := replicaAddrs()
+	mode := ackModeFor(r.Header.Get("X-Consistency"))
+	switch mode {
+	case "async":
+		notifyReplicators()
+		return true, nil
+
+	case "semi-sync", "quorum":
+		need := 1
+		if mode == "quorum" {
+			need = NodesNeeded("quorum") - 1
+		}
+		if len(addrs) == 0 || need <= 0 {
+			return true, nil
+		}
+
+		resultCh := make(chan ReplicaResult, len(addrs))
+		for _, addr := range addrs {
+			go func(addr string) {
+				resultCh <- syncOne(addr, entry)
+			}(addr)
+		}
+
+		var results []ReplicaResult
+		acks := 0
+		for range addrs {
+			res := <-resultCh
+			results = append(results, res)
+			if res.Acked() {
+				acks++
+			}
+			if acks >= need {
+				return true, results
+			}
+		}
+		return false, results
+
+	default:
+		results := make([]ReplicaResult, len(addrs))
+		var wg sync.WaitGroup
+		for i, addr := range addrs {
+			wg.Add(1)
+			go func(i int, addr string) {
+				defer wg.Done()
+				results[i] = syncOne(addr, entry)
+			}(i, addr)
+		}
+		wg.Wait()
+
+		for _, res := range results {
+			if !res.Acked() {
+				return false, results
+			}
+		}
+		return true, results
+	}
+}
+
+// ReplicationFailed answers the client when the ack mode could not be satisfied
+func ReplicationFailed(w http.ResponseWriter, r *http.Request, newMemo Memo, results []ReplicaResult) {
+	SetAckHeader(w, results)
+
+	response, _ := json.Marshal(map[string]interface{}{
+		"msg":  fmt.Sprintf("replication not acknowledged (ack mode %s)", ackModeFor(r.Header.Get("X-Consistency"))),
+		"memo": newMemo,
+		"acks": w.Header().Get("X-Replica-Acks"),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	_, _ = w.Write(response)
+	fmt.Printf("[2023 %s] %s SERVER [REPLY]          [METHOD: %s] %s\n", time.Now().Format(time.StampNano), Role, r.Method, string(response))
+}
+
+// SetAckHeader reports how many replicas acknowledged the update, e.g. "X-Replica-Acks: 2/3"
+func SetAckHeader(w http.ResponseWriter, results []ReplicaResult) {
+	acks := 0
+	for _, res := range results {
+		if res.Acked() {
+			acks++
+		}
+	}
+	if w.Header().Get("X-Consistency") != "" {
+		// nodes that stored the write, this one included
+		w.Header().Set("X-Consistency-Confirmed", fmt.Sprintf("%d/%d", acks+1, len(Config.Replicas)))
+	}
+
+	if results == nil && ackModeFor(w.Header().Get("X-Consistency")) == "async" && Config.Sync != "local-write" {
+		w.Header().Set("X-Replica-Acks", "queued")
+		return
+	}
+	w.Header().Set("X-Replica-Acks", fmt.Sprintf("%d/%d", acks, len(results)))
+}
+
+/*
+	Replication queues
+
+	Each replica has an outbound queue that is a cursor into the replication log: every entry after the
+	replica's last acknowledged sequence number is still pending. A background worker per replica delivers
+	pending entries in order and backs off exponentially while the replica is unreachable, so nothing is
+	lost while it is down. The queues live as long as the log itself. Every node runs them and only the
+	primary of the moment feeds them, a replica promoted after a failover learns each cursor from the
+	first answer, which reports the sequence number the replica already applied.
+*/
+
+type replicaQueue struct {
+	addr      string
+	ackedSeq  uint64
+	failures  int
+	retries   int
+	lastError string
+	nextRetry time.Time
+	wake      chan struct{}
+}
+
+var (
+	queues   = make(map[string]*replicaQueue) // replica address -> queue
+	queuesMu sync.Mutex
+)
+
+func startReplicators() {
+	queuesMu.Lock()
+	defer queuesMu.Unlock()
+
+	for _, addr := range replicaAddrs() {
+		q := &replicaQueue{addr: addr, wake: make(chan struct{}, 1)}
+		queues[addr] = q
+		go q.run()
+	}
+}
+
+// notifyReplicators wakes every queue worker to look for pending entries
+func notifyReplicators() {
+	queuesMu.Lock()
+	defer queuesMu.Unlock()
+
+	for _, q := range queues {
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// recordAck moves the replica's cursor forward, the replica may report having applied more than was sent
+func recordAck(addr string, sent uint64, applied uint64) {
+	queuesMu.Lock()
+	defer queuesMu.Unlock()
+
+	q, ok := queues[addr]
+	if !ok {
+		return
+	}
+	if sent > q.ackedSeq {
+		q.ackedSeq = sent
+	}
+	if applied > q.ackedSeq {
+		q.ackedSeq = applied
+	}
+}
+
+// logEntryAt must be called with memosMu held
+func logEntryAt(seq uint64) (LogEntry, bool) {
+	if len(ReplLog) == 0 || seq < ReplLog[0].Seq {
+		return LogEntry{}, false
+	}
+	i := int(seq - ReplLog[0].Seq)
+	if i >= len(ReplLog) {
+		return LogEntry{}, false
+	}
+	return ReplLog[i], true
+}
+
+func (q *replicaQueue) nextPending() (LogEntry, bool) {
+	queuesMu.Lock()
+	seq := q.ackedSeq + 1
+	queuesMu.Unlock()
+
+	MemosMu.Lock()
+	defer MemosMu.Unlock()
+	if seq < LogStart {
+		// the entries were compacted away, the replica sees the gap and installs a snapshot
+		seq = LogStart
+	}
+	return logEntryAt(seq)
+}
+
+func (q *replicaQueue) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	backoff := MinRetryBackoff
+	for {
+		select {
+		case <-q.wake:
+		case <-ticker.C:
+		}
+
+		for {
+			// only the primary feeds the queues, after stepping down the new primary does
+			if !AmPrimary() {
+				break
+			}
+			entry, ok := q.nextPending()
+			if !ok {
+				break
+			}
+
+			res := syncOne(q.addr, entry)
+			if res.Acked() {
+				queuesMu.Lock()
+				q.failures = 0
+				q.lastError = ""
+				queuesMu.Unlock()
+				backoff = MinRetryBackoff
+				continue
+			}
+
+			queuesMu.Lock()
+			q.failures++
+			q.retries++
+			if res.Err != nil {
+				q.lastError = res.Err.Error()
+			} else {
+				q.lastError = fmt.Sprintf("status %d", res.StatusCode)
+			}
+			q.nextRetry = time.Now().Add(backoff)
+			queuesMu.Unlock()
+
+			fmt.Printf("[2023 %s] %s SERVER [RETRY QUEUE]    [%s] seq %d failed, retrying in %s\n", time.Now().Format(time.StampNano), Role, q.addr, entry.Seq, backoff)
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > MaxRetryBackoff {
+				backoff = MaxRetryBackoff
+			}
+		}
+	}
+}
+
+// replicationQueues reports queue depth and the age of the oldest pending entry for every replica
+func replicationQueues(w http.ResponseWriter, r *http.Request) {
+	type queueStatus struct {
+		Replica            string `json:"replica"`
+		AckedSeq           uint64 `json:"ackedSeq"`
+		Depth              uint64 `json:"depth"`
+		OldestPendingAgeMs int64  `json:"oldestPendingAgeMs"`
+		Failures           int    `json:"consecutiveFailures"`
+		Retries            int    `json:"retries"`
+		LastError          string `json:"lastError,omitempty"`
+		NextRetryInMs      int64  `json:"nextRetryInMs,omitempty"`
+	}
+
+	MemosMu.Lock()
+	seq := LastSeq
+	MemosMu.Unlock()
+
+	var statuses []queueStatus
+	queuesMu.Lock()
+	for _, q := range queues {
+		status := queueStatus{
+			Replica:   "http://" + q.addr + "/note",
+			AckedSeq:  q.ackedSeq,
+			Failures:  q.failures,
+			Retries:   q.retries,
+			LastError: q.lastError,
+		}
+		if seq > q.ackedSeq {
+			status.Depth = seq - q.ackedSeq
+		}
+		if q.failures > 0 && time.Until(q.nextRetry) > 0 {
+			status.NextRetryInMs = time.Until(q.nextRetry).Milliseconds()
+		}
+		statuses = append(statuses, status)
+	}
+	queuesMu.Unlock()
+
+	MemosMu.Lock()
+	for i := range statuses {
+		if statuses[i].Depth == 0 {
+			continue
+		}
+		// entries a promoted node received from the old primary carry no time
+		if entry, ok := logEntryAt(statuses[i].AckedSeq + 1); ok && !entry.Time.IsZero() {
+			statuses[i].OldestPendingAgeMs = time.Since(entry.Time).Milliseconds()
+		}
+	}
+	MemosMu.Unlock()
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Replica < statuses[j].Replica })
+
+	response, err := json.Marshal(statuses)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(response)
+}
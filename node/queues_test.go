@@ -0,0 +1,31 @@
+package node
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestReplicateUpdateAckModes checks that a write one replica did not acknowledge fails the sync mode and
+// satisfies the semi-sync mode
+func TestReplicateUpdateAckModes(t *testing.T) {
+	replica := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer replica.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	Config = Configuration{Replicas: []string{"127.0.0.1:1", replica.Listener.Addr().String(), down.Listener.Addr().String()}}
+	SelfAddr = Config.Replicas[0]
+	entry := LogEntry{Seq: 1, Method: http.MethodPost, Memo: Memo{ID: 1, Title: "memo", Version: 1}}
+	r := httptest.NewRequest(http.MethodPost, "/note", nil)
+
+	for ack, want := range map[string]bool{"sync": false, "semi-sync": true} {
+		Config.Ack = ack
+		ok, results := ReplicateUpdate(r, entry)
+		if ok != want {
+			t.Fatalf("ack %s satisfied %v with results %+v", ack, ok, results)
+		}
+	}
+}
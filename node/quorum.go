@@ -0,0 +1,517 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/*
+	Quorum mode ("sync": "quorum")
+
+	There is no primary, whichever node receives a request coordinates it. Every memo is stored on
+	replicationFactor nodes picked from its ID, a write succeeds once writeQuorum of them stored it and a
+	read returns the newest version among the first readQuorum answers. Versions compare by counter and
+	then by the node that wrote them. A deleted memo is kept as a tombstone so that a node that missed the
+	delete cannot bring it back through a read quorum. Before its first POST a node reads its ID stripe back
+	from the other nodes that store it, a node that lost its memos in a restart would reuse IDs otherwise.
+*/
+
+// quorumRecord is what a node stores for one memo in quorum mode, and one version in multi-primary mode
+type quorumRecord struct {
+	Memo    Memo     `json:"memo"`
+	Deleted bool     `json:"deleted,omitempty"`
+	Ops     *crdtOps `json:"ops,omitempty"` // multi-primary mode with CRDT memos only
+}
+
+// quorumReply is one node's answer to a coordinator
+type quorumReply struct {
+	node  string
+	rec   quorumRecord
+	found bool
+	err   error
+}
+
+var (
+	tombstones      = make(map[int]Memo) // deleted memo ID -> version of the delete
+	stripeRecovered bool                 // IDCount covers the IDs the other nodes store, guarded by memosMu
+)
+
+func replicationFactor() int {
+	if Config.ReplicationFactor <= 0 || Config.ReplicationFactor > len(Config.Replicas) {
+		return len(Config.Replicas)
+	}
+	return Config.ReplicationFactor
+}
+
+func quorumSize(configured int) int {
+	n := replicationFactor()
+	if configured <= 0 {
+		return n/2 + 1
+	}
+	if configured > n {
+		return n
+	}
+	return configured
+}
+
+func writeQuorum() int {
+	return quorumSize(Config.WriteQuorum)
+}
+
+func readQuorum() int {
+	return quorumSize(Config.ReadQuorum)
+}
+
+// newerVersion reports whether a was written after b
+func newerVersion(a, b Memo) bool {
+	if a.Version != b.Version {
+		return a.Version > b.Version
+	}
+	return a.VersionNode > b.VersionNode
+}
+
+// preferenceList returns the nodes that store the memo, starting at the node that striped its ID
+func preferenceList(id int) []string {
+	n := len(Config.Replicas)
+	nodes := make([]string, 0, replicationFactor())
+	for i := 0; i < replicationFactor(); i++ {
+		nodes = append(nodes, Config.Replicas[((id-1)%n+n+i)%n])
+	}
+	return nodes
+}
+
+// quorumLocal must be called with memosMu held
+func quorumLocal(id int) (quorumRecord, bool) {
+	if memo, ok := tombstones[id]; ok {
+		return quorumRecord{Memo: memo, Deleted: true}, true
+	}
+	if memo, ok := GetMemo(id); ok {
+		return quorumRecord{Memo: memo}, true
+	}
+	return quorumRecord{}, false
+}
+
+// quorumStore keeps the record unless a newer version is stored already, must be called with memosMu held
+func quorumStore(rec quorumRecord) {
+	if current, ok := quorumLocal(rec.Memo.ID); ok && !newerVersion(rec.Memo, current.Memo) {
+		return
+	}
+	if rec.Deleted {
+		removeMemo(rec.Memo.ID)
+		tombstones[rec.Memo.ID] = rec.Memo
+	} else {
+		delete(tombstones, rec.Memo.ID)
+		upsertMemo(rec.Memo)
+	}
+}
+
+// handleQuorumStore serves a coordinator's GET and PUT of a single record, a PUT replies with whatever
+// version the node keeps afterwards
+func handleQuorumStore(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	var rec quorumRecord
+	if r.Method == http.MethodPut {
+		err = json.NewDecoder(r.Body).Decode(&rec)
+		if err != nil || rec.Memo.ID != id {
+			http.Error(w, "Invalid record", http.StatusBadRequest)
+			return
+		}
+	}
+
+	MemosMu.Lock()
+	if r.Method == http.MethodPut {
+		quorumStore(rec)
+	}
+	rec, ok := quorumLocal(id)
+	MemosMu.Unlock()
+	if !ok {
+		http.Error(w, "Memo not found", http.StatusNotFound)
+		return
+	}
+
+	response, err := json.Marshal(rec)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(response)
+}
+
+// handleQuorumList returns every record of this node, tombstones included
+func handleQuorumList(w http.ResponseWriter, r *http.Request) {
+	MemosMu.Lock()
+	memos := AllMemos()
+	records := make([]quorumRecord, 0, len(memos)+len(tombstones))
+	for _, memo := range memos {
+		records = append(records, quorumRecord{Memo: memo})
+	}
+	for _, memo := range tombstones {
+		records = append(records, quorumRecord{Memo: memo, Deleted: true})
+	}
+	response, err := json.Marshal(records)
+	MemosMu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(response)
+}
+
+// quorumCall reads the record from a node, or stores rec there when it is not nil. A write only counts
+// when the node keeps exactly this version afterwards.
+func quorumCall(node string, id int, rec *quorumRecord) quorumReply {
+	reply := quorumReply{node: node}
+	client := http.Client{Timeout: 2 * time.Second}
+	url := fmt.Sprintf("http://%s/quorum/store/%d", node, id)
+
+	var resp *http.Response
+	var err error
+	if rec == nil {
+		resp, err = client.Get(url)
+	} else {
+		data, _ := json.Marshal(rec)
+		req, reqErr := http.NewRequest(http.MethodPut, url, bytes.NewReader(data))
+		if reqErr != nil {
+			reply.err = reqErr
+			return reply
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err = client.Do(req)
+	}
+	if err != nil {
+		reply.err = err
+		return reply
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		reply.err = json.NewDecoder(resp.Body).Decode(&reply.rec)
+		reply.found = reply.err == nil
+	case http.StatusNotFound:
+		// the node never stored this memo, that is an answer as well
+	default:
+		reply.err = fmt.Errorf("%s", resp.Status)
+	}
+
+	if rec != nil && reply.err == nil && (!reply.found || reply.rec.Memo.Version != rec.Memo.Version || reply.rec.Memo.VersionNode != rec.Memo.VersionNode) {
+		reply.err = fmt.Errorf("superseded by version %d from %s", reply.rec.Memo.Version, reply.rec.Memo.VersionNode)
+	}
+	return reply
+}
+
+// askNodes calls every node in parallel and returns once need of them answered without error,
+// the remaining calls finish in the background
+func askNodes(nodes []string, need int, call func(node string) quorumReply) ([]quorumReply, bool) {
+	replyCh := make(chan quorumReply, len(nodes))
+	for _, node := range nodes {
+		go func(node string) {
+			replyCh <- call(node)
+		}(node)
+	}
+
+	var replies []quorumReply
+	answered := 0
+	for range nodes {
+		reply := <-replyCh
+		replies = append(replies, reply)
+		if reply.err != nil {
+			fmt.Printf("[2023 %s] %s SERVER [QUORUM]         [%s] FAILED (%s)\n", time.Now().Format(time.StampNano), Role, reply.node, reply.err)
+			continue
+		}
+		answered++
+		if answered >= need {
+			return replies, true
+		}
+	}
+	return replies, false
+}
+
+// quorumRead returns the newest record of the memo among readQuorum answers
+func quorumRead(id int) (quorumRecord, bool, error) {
+	replies, ok := askNodes(preferenceList(id), readQuorum(), func(node string) quorumReply {
+		return quorumCall(node, id, nil)
+	})
+	if !ok {
+		return quorumRecord{}, false, fmt.Errorf("read quorum of %d not reached", readQuorum())
+	}
+
+	var newest quorumRecord
+	found := false
+	for _, reply := range replies {
+		if reply.err == nil && reply.found && (!found || newerVersion(reply.rec.Memo, newest.Memo)) {
+			newest, found = reply.rec, true
+		}
+	}
+	return newest, found, nil
+}
+
+// quorumWrite stores the record on the memo's nodes and reports how many acknowledged it
+func quorumWrite(rec quorumRecord) (int, bool) {
+	replies, ok := askNodes(preferenceList(rec.Memo.ID), writeQuorum(), func(node string) quorumReply {
+		return quorumCall(node, rec.Memo.ID, &rec)
+	})
+
+	acks := 0
+	for _, reply := range replies {
+		if reply.err == nil {
+			acks++
+		}
+	}
+	return acks, ok
+}
+
+// quorumRecords merges the records of at least need of the nodes, keeping the newest version of every memo
+func quorumRecords(nodes []string, need int) (map[int]quorumRecord, error) {
+	client := http.Client{Timeout: 2 * time.Second}
+	replyCh := make(chan []quorumRecord, len(nodes))
+	for _, node := range nodes {
+		go func(node string) {
+			var records []quorumRecord
+			resp, err := client.Get("http://" + node + "/quorum/store")
+			if err != nil {
+				replyCh <- nil
+				return
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&records) != nil {
+				replyCh <- nil
+				return
+			}
+			replyCh <- records
+		}(node)
+	}
+
+	newest := make(map[int]quorumRecord)
+	answered := 0
+	for range nodes {
+		records := <-replyCh
+		if records == nil {
+			continue
+		}
+		answered++
+		for _, rec := range records {
+			if current, ok := newest[rec.Memo.ID]; !ok || newerVersion(rec.Memo, current.Memo) {
+				newest[rec.Memo.ID] = rec
+			}
+		}
+	}
+	if answered < need {
+		return nil, fmt.Errorf("read quorum of %d not reached", need)
+	}
+	return newest, nil
+}
+
+// quorumList merges the records of at least readQuorum nodes and returns the memos that are not deleted
+func quorumList() ([]Memo, error) {
+	newest, err := quorumRecords(Config.Replicas, readQuorum())
+	if err != nil {
+		return nil, err
+	}
+
+	list := []Memo{}
+	for _, rec := range newest {
+		if !rec.Deleted {
+			list = append(list, rec.Memo)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list, nil
+}
+
+// recoverStripe raises IDCount past every ID of this node's stripe that a read quorum of the other nodes
+// storing the stripe returns, tombstones included
+func recoverStripe() error {
+	var others []string
+	for _, node := range preferenceList(selfIndex + 1) {
+		if node != SelfAddr {
+			others = append(others, node)
+		}
+	}
+	need := readQuorum()
+	if need > len(others) {
+		need = len(others)
+	}
+
+	records, err := quorumRecords(others, need)
+	if err != nil {
+		return err
+	}
+
+	MemosMu.Lock()
+	defer MemosMu.Unlock()
+	for id := range records {
+		observeStripeID(id)
+	}
+	stripeRecovered = true
+	fmt.Printf("[2023 %s] %s SERVER [RECOVER]        new memos start at ID %d\n", time.Now().Format(time.StampNano), Role, IDCount*len(Config.Replicas)+selfIndex+1)
+	return nil
+}
+
+// observeStripeID keeps IDCount past an ID of this node's stripe, must be called with memosMu held
+func observeStripeID(id int) {
+	n := len(Config.Replicas)
+	if (id-1)%n == selfIndex && (id-1)/n+1 > IDCount {
+		IDCount = (id-1)/n + 1
+	}
+}
+
+// QuorumRequest coordinates a client request in quorum mode
+func QuorumRequest(w http.ResponseWriter, r *http.Request) {
+	LogRequest(r, "Received ", r.Method, " request")
+
+	idStr, hasID := mux.Vars(r)["id"]
+	if !hasID {
+		if r.Method == http.MethodGet {
+			list, err := quorumList()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			response, err := json.Marshal(list)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write(response)
+			return
+		}
+
+		var newMemo Memo
+		err := json.NewDecoder(r.Body).Decode(&newMemo)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		MemosMu.Lock()
+		recovered := stripeRecovered
+		MemosMu.Unlock()
+		if !recovered {
+			if err := recoverStripe(); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+
+		// IDs are striped by node index like in local-write mode, so coordinators never collide
+		MemosMu.Lock()
+		IDCount++
+		newMemo.ID = (IDCount-1)*len(Config.Replicas) + selfIndex + 1
+		MemosMu.Unlock()
+		newMemo.Version = 1
+		newMemo.VersionNode = SelfAddr
+
+		quorumReplyWrite(w, r, quorumRecord{Memo: newMemo}, http.StatusCreated)
+		return
+	}
+
+	id, err := strconv.Atoi(idStr)
+	if err != nil || id < 1 {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	var requestBody map[string]string
+	if r.Method == http.MethodPatch || r.Method == http.MethodPut {
+		err = json.NewDecoder(r.Body).Decode(&requestBody)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	current, found, err := quorumRead(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if !found || current.Deleted {
+		http.Error(w, "Memo not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		response, err := json.Marshal(current.Memo)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		SetETag(w, current.Memo)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(response)
+		return
+	}
+
+	if !IfMatch(r, current.Memo) {
+		PreconditionFailed(w, r, current.Memo)
+		return
+	}
+
+	rec := current
+	switch r.Method {
+	case http.MethodDelete:
+		rec.Deleted = true
+	case http.MethodPut:
+		rec.Memo.Title = requestBody["title"]
+		rec.Memo.Body = requestBody["body"]
+	case http.MethodPatch:
+		if newBody, ok := requestBody["body"]; ok {
+			rec.Memo.Body = newBody
+		}
+		if newTitle, ok := requestBody["title"]; ok {
+			rec.Memo.Title = newTitle
+		}
+	}
+	rec.Memo.Version++
+	rec.Memo.VersionNode = SelfAddr
+
+	quorumReplyWrite(w, r, rec, http.StatusOK)
+}
+
+// quorumReplyWrite writes the record with the write quorum and answers the client
+func quorumReplyWrite(w http.ResponseWriter, r *http.Request, rec quorumRecord, status int) {
+	acks, ok := quorumWrite(rec)
+	w.Header().Set("X-Replica-Acks", fmt.Sprintf("%d/%d", acks, replicationFactor()))
+	if !ok {
+		http.Error(w, fmt.Sprintf("write quorum of %d not reached", writeQuorum()), http.StatusServiceUnavailable)
+		return
+	}
+
+	response := []byte(`{"msg": "OK"}`)
+	if !rec.Deleted {
+		var err error
+		response, err = json.Marshal(rec.Memo)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		SetETag(w, rec.Memo)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(response)
+	fmt.Printf("[2023 %s] %s SERVER [QUORUM WRITE]   [METHOD: %s] version %d acked by %d/%d\n", time.Now().Format(time.StampNano), Role, r.Method, rec.Memo.Version, acks, replicationFactor())
+}
@@ -0,0 +1,45 @@
+package node
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestRecoverStripe checks that a node that lost its memos continues its ID stripe after the IDs the
+// other nodes still store, deleted ones included
+func TestRecoverStripe(t *testing.T) {
+	peer := func(records []quorumRecord) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_ = json.NewEncoder(w).Encode(records)
+		}))
+	}
+	a := peer([]quorumRecord{{Memo: Memo{ID: 4, Version: 1, VersionNode: "127.0.0.1:1"}}})
+	defer a.Close()
+	b := peer([]quorumRecord{
+		{Memo: Memo{ID: 7, Version: 2, VersionNode: "127.0.0.1:1"}, Deleted: true},
+		{Memo: Memo{ID: 5, Version: 1}},
+	})
+	defer b.Close()
+
+	Config = Configuration{Sync: "quorum", Replicas: []string{"127.0.0.1:1", strings.TrimPrefix(a.URL, "http://"), strings.TrimPrefix(b.URL, "http://")}}
+	SelfAddr, selfIndex = Config.Replicas[0], 0
+	MemoStore = &memoryStore{}
+	IDCount, stripeRecovered = 0, false
+
+	if err := recoverStripe(); err != nil {
+		t.Fatalf("recoverStripe: %s", err)
+	}
+	if IDCount != 3 || !stripeRecovered {
+		t.Fatalf("IDCount is %d after recovery, expected 3 so the next ID is 10", IDCount)
+	}
+
+	// without a read quorum of the other nodes nothing is served
+	b.Close()
+	stripeRecovered = false
+	if err := recoverStripe(); err == nil {
+		t.Fatalf("recoverStripe succeeded with one of two nodes answering")
+	}
+}
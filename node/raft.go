@@ -0,0 +1,793 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Raft mode ("sync": "raft")
+
+	The nodes in config.json run Raft for leader election and log replication. A client write is turned
+	into a log entry on the leader and answered only once a majority has stored it and it has been applied.
+	Followers forward writes to the leader they know about. A raftNode only talks to its peers through a
+	raftTransport, so several nodes can run in one process over localTransport.
+
+	The term, the vote and the log are appended to raftLog (default raft-<node>.log) and fsynced before the
+	node answers a RequestVote or AppendEntries, starts an election or counts a proposal, so a restarted
+	node neither votes twice in a term nor forgets entries it stored. The file is compacted to one record on
+	startup. The memos are not in it: a restarted node applies its log from the start again once it learns
+	the commit index, which is why raft mode runs on the memory store.
+*/
+
+type raftEntry struct {
+	Term  uint64   `json:"term"`
+	Index uint64   `json:"index"`
+	Op    LogEntry `json:"op"`
+}
+
+type requestVoteArgs struct {
+	Term         uint64 `json:"term"`
+	CandidateID  string `json:"candidateId"`
+	LastLogIndex uint64 `json:"lastLogIndex"`
+	LastLogTerm  uint64 `json:"lastLogTerm"`
+}
+
+type requestVoteReply struct {
+	Term        uint64 `json:"term"`
+	VoteGranted bool   `json:"voteGranted"`
+}
+
+type appendEntriesArgs struct {
+	Term         uint64      `json:"term"`
+	LeaderID     string      `json:"leaderId"`
+	PrevLogIndex uint64      `json:"prevLogIndex"`
+	PrevLogTerm  uint64      `json:"prevLogTerm"`
+	Entries      []raftEntry `json:"entries"`
+	LeaderCommit uint64      `json:"leaderCommit"`
+}
+
+type appendEntriesReply struct {
+	Term          uint64 `json:"term"`
+	Success       bool   `json:"success"`
+	ConflictIndex uint64 `json:"conflictIndex"`
+}
+
+type raftTransport interface {
+	RequestVote(peer string, args requestVoteArgs) (requestVoteReply, error)
+	AppendEntries(peer string, args appendEntriesArgs) (appendEntriesReply, error)
+}
+
+const (
+	raftFollower = iota
+	raftCandidate
+	raftLeader
+)
+
+// raftRecord is one line of the raft log file: the term and vote, and the entries from Entries[0].Index
+// on, which replace whatever earlier lines held from that index
+type raftRecord struct {
+	Term     uint64      `json:"term"`
+	VotedFor string      `json:"votedFor"`
+	Entries  []raftEntry `json:"entries,omitempty"`
+}
+
+type raftWaiter struct {
+	term uint64
+	ch   chan applyResult
+}
+
+type raftNode struct {
+	mu        sync.Mutex
+	id        string
+	peers     []string
+	transport raftTransport
+	apply     func(LogEntry) applyResult
+
+	currentTerm uint64
+	votedFor    string
+	log         []raftEntry // log[0] is a sentinel so that log[i].Index == i
+	commitIndex uint64
+	lastApplied uint64
+	state       int
+	leaderID    string
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+
+	electionReset   time.Time
+	electionTimeout time.Duration
+	heartbeatEvery  time.Duration
+	lastBroadcast   time.Time
+	waiters         map[uint64]raftWaiter
+	applyCh         chan struct{}
+	stopCh          chan struct{}
+	logFile         *os.File // nil keeps the state in memory only, as the in-process tests do
+}
+
+var errNotLeader = fmt.Errorf("not the raft leader")
+
+func newRaftNode(id string, peers []string, transport raftTransport, apply func(LogEntry) applyResult) *raftNode {
+	return &raftNode{
+		id:             id,
+		peers:          peers,
+		transport:      transport,
+		apply:          apply,
+		log:            []raftEntry{{}},
+		state:          raftFollower,
+		nextIndex:      make(map[string]uint64),
+		matchIndex:     make(map[string]uint64),
+		electionReset:  time.Now(),
+		heartbeatEvery: 50 * time.Millisecond,
+		waiters:        make(map[uint64]raftWaiter),
+		applyCh:        make(chan struct{}, 1),
+		stopCh:         make(chan struct{}),
+	}
+}
+
+func raftLogPath() string {
+	if Config.RaftLog != "" {
+		return Config.RaftLog
+	}
+	return "raft-" + strings.Replace(SelfAddr, ":", "_", -1) + ".log"
+}
+
+// openLog restores the term, the vote and the log from the file at path, rewrites the file as one record
+// and keeps it open for appending. It must be called before Start
+func (rn *raftNode) openLog(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		var rec raftRecord
+		if json.Unmarshal(line, &rec) != nil {
+			// the end of the file, or a torn record that was never acted on
+			break
+		}
+		if len(rec.Entries) > 0 && rec.Entries[0].Index > uint64(len(rn.log)) {
+			return fmt.Errorf("%s jumps to index %d with %d entries stored", path, rec.Entries[0].Index, len(rn.log)-1)
+		}
+		rn.currentTerm, rn.votedFor = rec.Term, rec.VotedFor
+		if len(rec.Entries) > 0 {
+			rn.log = append(rn.log[:rec.Entries[0].Index], rec.Entries...)
+		}
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	rn.logFile = f
+	rn.persist(rn.log[1:])
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("[2023 %s] RAFT [%s] [RECOVER]    term %d, %d entries\n", time.Now().Format(time.StampNano), rn.id, rn.currentTerm, len(rn.log)-1)
+	return syncDir(filepath.Dir(path))
+}
+
+// persist appends the term, the vote and the given entries to the raft log file and fsyncs it, a node that
+// cannot write it stops like it does when the write-ahead log fails. It must be called with rn.mu held
+func (rn *raftNode) persist(entries []raftEntry) {
+	if rn.logFile == nil {
+		return
+	}
+	line, err := json.Marshal(raftRecord{Term: rn.currentTerm, VotedFor: rn.votedFor, Entries: entries})
+	if err == nil {
+		_, err = rn.logFile.Write(append(line, '\n'))
+	}
+	if err == nil {
+		err = rn.logFile.Sync()
+	}
+	if err != nil {
+		log.Fatalf("Failed to write the raft log: %s\n", err)
+	}
+}
+
+func (rn *raftNode) Start() {
+	rn.mu.Lock()
+	rn.resetElectionTimer()
+	rn.mu.Unlock()
+
+	go rn.run()
+	go rn.applier()
+}
+
+func (rn *raftNode) Stop() {
+	close(rn.stopCh)
+}
+
+// Status returns the current term, whether this node is leader and the leader it knows about
+func (rn *raftNode) Status() (uint64, bool, string) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	return rn.currentTerm, rn.state == raftLeader, rn.leaderID
+}
+
+// resetElectionTimer must be called with rn.mu held
+func (rn *raftNode) resetElectionTimer() {
+	rn.electionReset = time.Now()
+	rn.electionTimeout = time.Duration(150+rand.Intn(150)) * time.Millisecond
+}
+
+func (rn *raftNode) lastLog() (uint64, uint64) {
+	last := rn.log[len(rn.log)-1]
+	return last.Index, last.Term
+}
+
+func (rn *raftNode) majority() int {
+	return (len(rn.peers)+1)/2 + 1
+}
+
+func (rn *raftNode) run() {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rn.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		rn.mu.Lock()
+		if rn.state == raftLeader {
+			if time.Since(rn.lastBroadcast) >= rn.heartbeatEvery {
+				rn.lastBroadcast = time.Now()
+				rn.mu.Unlock()
+				rn.broadcastAppend()
+				continue
+			}
+		} else if time.Since(rn.electionReset) >= rn.electionTimeout {
+			rn.mu.Unlock()
+			rn.startElection()
+			continue
+		}
+		rn.mu.Unlock()
+	}
+}
+
+// becomeFollower must be called with rn.mu held
+func (rn *raftNode) becomeFollower(term uint64) {
+	if rn.state == raftLeader {
+		fmt.Printf("[2023 %s] RAFT [%s] [STEP DOWN]  term %d\n", time.Now().Format(time.StampNano), rn.id, term)
+	}
+	rn.state = raftFollower
+	if term > rn.currentTerm {
+		rn.currentTerm = term
+		rn.votedFor = ""
+		rn.persist(nil)
+	}
+	rn.resetElectionTimer()
+}
+
+func (rn *raftNode) startElection() {
+	rn.mu.Lock()
+	rn.state = raftCandidate
+	rn.currentTerm++
+	rn.votedFor = rn.id
+	rn.persist(nil)
+	rn.leaderID = ""
+	rn.resetElectionTimer()
+	term := rn.currentTerm
+	lastIndex, lastTerm := rn.lastLog()
+	rn.mu.Unlock()
+
+	fmt.Printf("[2023 %s] RAFT [%s] [ELECTION]   term %d\n", time.Now().Format(time.StampNano), rn.id, term)
+
+	args := requestVoteArgs{Term: term, CandidateID: rn.id, LastLogIndex: lastIndex, LastLogTerm: lastTerm}
+	votes := 1
+	if votes >= rn.majority() {
+		rn.mu.Lock()
+		rn.becomeLeader()
+		rn.mu.Unlock()
+		return
+	}
+
+	for _, peer := range rn.peers {
+		go func(peer string) {
+			reply, err := rn.transport.RequestVote(peer, args)
+			if err != nil {
+				return
+			}
+
+			rn.mu.Lock()
+			defer rn.mu.Unlock()
+
+			if reply.Term > rn.currentTerm {
+				rn.becomeFollower(reply.Term)
+				return
+			}
+			if rn.state != raftCandidate || rn.currentTerm != term || !reply.VoteGranted {
+				return
+			}
+			votes++
+			if votes >= rn.majority() {
+				rn.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// becomeLeader must be called with rn.mu held
+func (rn *raftNode) becomeLeader() {
+	rn.state = raftLeader
+	rn.leaderID = rn.id
+	lastIndex, _ := rn.lastLog()
+	for _, peer := range rn.peers {
+		rn.nextIndex[peer] = lastIndex + 1
+		rn.matchIndex[peer] = 0
+	}
+	rn.lastBroadcast = time.Time{}
+	fmt.Printf("[2023 %s] RAFT [%s] [LEADER]     term %d\n", time.Now().Format(time.StampNano), rn.id, rn.currentTerm)
+}
+
+func (rn *raftNode) broadcastAppend() {
+	for _, peer := range rn.peers {
+		go rn.replicateTo(peer)
+	}
+}
+
+func (rn *raftNode) replicateTo(peer string) {
+	rn.mu.Lock()
+	if rn.state != raftLeader {
+		rn.mu.Unlock()
+		return
+	}
+	next := rn.nextIndex[peer]
+	if next < 1 {
+		next = 1
+	}
+	prev := rn.log[next-1]
+	entries := append([]raftEntry{}, rn.log[next:]...)
+	args := appendEntriesArgs{
+		Term:         rn.currentTerm,
+		LeaderID:     rn.id,
+		PrevLogIndex: prev.Index,
+		PrevLogTerm:  prev.Term,
+		Entries:      entries,
+		LeaderCommit: rn.commitIndex,
+	}
+	rn.mu.Unlock()
+
+	reply, err := rn.transport.AppendEntries(peer, args)
+	if err != nil {
+		return
+	}
+
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	if reply.Term > rn.currentTerm {
+		rn.becomeFollower(reply.Term)
+		return
+	}
+	if rn.state != raftLeader || rn.currentTerm != args.Term {
+		return
+	}
+
+	if reply.Success {
+		match := args.PrevLogIndex + uint64(len(entries))
+		if match > rn.matchIndex[peer] {
+			rn.matchIndex[peer] = match
+		}
+		rn.nextIndex[peer] = rn.matchIndex[peer] + 1
+		rn.advanceCommit()
+	} else if reply.ConflictIndex >= 1 {
+		rn.nextIndex[peer] = reply.ConflictIndex
+	} else {
+		rn.nextIndex[peer] = 1
+	}
+}
+
+// advanceCommit commits the highest index of the current term stored on a majority, rn.mu must be held
+func (rn *raftNode) advanceCommit() {
+	lastIndex, _ := rn.lastLog()
+	for n := lastIndex; n > rn.commitIndex; n-- {
+		if rn.log[n].Term != rn.currentTerm {
+			break
+		}
+		count := 1
+		for _, peer := range rn.peers {
+			if rn.matchIndex[peer] >= n {
+				count++
+			}
+		}
+		if count >= rn.majority() {
+			rn.commitIndex = n
+			rn.signalApply()
+			return
+		}
+	}
+}
+
+func (rn *raftNode) signalApply() {
+	select {
+	case rn.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+// applier hands committed entries to the state machine in log order
+func (rn *raftNode) applier() {
+	for {
+		select {
+		case <-rn.stopCh:
+			return
+		case <-rn.applyCh:
+		}
+
+		rn.mu.Lock()
+		entries := append([]raftEntry{}, rn.log[rn.lastApplied+1:rn.commitIndex+1]...)
+		rn.lastApplied = rn.commitIndex
+		rn.mu.Unlock()
+
+		for _, entry := range entries {
+			res := rn.apply(entry.Op)
+
+			rn.mu.Lock()
+			waiter, ok := rn.waiters[entry.Index]
+			delete(rn.waiters, entry.Index)
+			rn.mu.Unlock()
+
+			if !ok {
+				continue
+			}
+			if waiter.term != entry.Term {
+				// our proposal was overwritten by another leader's entry
+				waiter.ch <- applyResult{StatusCode: http.StatusServiceUnavailable, Response: []byte("Leadership changed, write not committed")}
+			} else {
+				waiter.ch <- res
+			}
+		}
+	}
+}
+
+// Propose appends the operation to the leader's log and waits until it is committed and applied
+func (rn *raftNode) Propose(op LogEntry, timeout time.Duration) (applyResult, error) {
+	rn.mu.Lock()
+	if rn.state != raftLeader {
+		rn.mu.Unlock()
+		return applyResult{}, errNotLeader
+	}
+	lastIndex, _ := rn.lastLog()
+	entry := raftEntry{Term: rn.currentTerm, Index: lastIndex + 1, Op: op}
+	rn.log = append(rn.log, entry)
+	rn.persist([]raftEntry{entry})
+	ch := make(chan applyResult, 1)
+	rn.waiters[entry.Index] = raftWaiter{term: entry.Term, ch: ch}
+	if len(rn.peers) == 0 {
+		rn.advanceCommit()
+	}
+	rn.mu.Unlock()
+
+	rn.broadcastAppend()
+
+	select {
+	case res := <-ch:
+		return res, nil
+	case <-time.After(timeout):
+		rn.mu.Lock()
+		delete(rn.waiters, entry.Index)
+		rn.mu.Unlock()
+		return applyResult{}, fmt.Errorf("entry %d not committed within %s", entry.Index, timeout)
+	}
+}
+
+func (rn *raftNode) HandleRequestVote(args requestVoteArgs) requestVoteReply {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	if args.Term > rn.currentTerm {
+		rn.becomeFollower(args.Term)
+	}
+	reply := requestVoteReply{Term: rn.currentTerm}
+	if args.Term < rn.currentTerm {
+		return reply
+	}
+
+	lastIndex, lastTerm := rn.lastLog()
+	upToDate := args.LastLogTerm > lastTerm || (args.LastLogTerm == lastTerm && args.LastLogIndex >= lastIndex)
+	if (rn.votedFor == "" || rn.votedFor == args.CandidateID) && upToDate {
+		rn.votedFor = args.CandidateID
+		rn.persist(nil)
+		rn.resetElectionTimer()
+		reply.VoteGranted = true
+	}
+	return reply
+}
+
+func (rn *raftNode) HandleAppendEntries(args appendEntriesArgs) appendEntriesReply {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	if args.Term > rn.currentTerm || (args.Term == rn.currentTerm && rn.state != raftFollower) {
+		rn.becomeFollower(args.Term)
+	}
+	reply := appendEntriesReply{Term: rn.currentTerm}
+	if args.Term < rn.currentTerm {
+		return reply
+	}
+	rn.leaderID = args.LeaderID
+	rn.resetElectionTimer()
+
+	lastIndex, _ := rn.lastLog()
+	if args.PrevLogIndex > lastIndex {
+		reply.ConflictIndex = lastIndex + 1
+		return reply
+	}
+	if rn.log[args.PrevLogIndex].Term != args.PrevLogTerm {
+		// skip back over the whole conflicting term
+		conflictTerm := rn.log[args.PrevLogIndex].Term
+		i := args.PrevLogIndex
+		for i > 1 && rn.log[i-1].Term == conflictTerm {
+			i--
+		}
+		reply.ConflictIndex = i
+		return reply
+	}
+
+	for i, entry := range args.Entries {
+		if entry.Index < uint64(len(rn.log)) {
+			if rn.log[entry.Index].Term == entry.Term {
+				continue
+			}
+			rn.log = rn.log[:entry.Index]
+		}
+		rn.log = append(rn.log, args.Entries[i:]...)
+		rn.persist(args.Entries[i:])
+		break
+	}
+
+	if args.LeaderCommit > rn.commitIndex {
+		lastIndex, _ = rn.lastLog()
+		rn.commitIndex = args.LeaderCommit
+		if lastIndex < rn.commitIndex {
+			rn.commitIndex = lastIndex
+		}
+		rn.signalApply()
+	}
+
+	reply.Success = true
+	return reply
+}
+
+// httpTransport sends Raft messages to the /raft endpoints of the other nodes
+type httpTransport struct {
+	client http.Client
+}
+
+func (t *httpTransport) post(peer string, path string, args interface{}, reply interface{}) error {
+	data, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.client.Post("http://"+peer+path, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s failed: %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(reply)
+}
+
+func (t *httpTransport) RequestVote(peer string, args requestVoteArgs) (requestVoteReply, error) {
+	var reply requestVoteReply
+	err := t.post(peer, "/raft/vote", args, &reply)
+	return reply, err
+}
+
+func (t *httpTransport) AppendEntries(peer string, args appendEntriesArgs) (appendEntriesReply, error) {
+	var reply appendEntriesReply
+	err := t.post(peer, "/raft/append", args, &reply)
+	return reply, err
+}
+
+var raft *raftNode
+
+func handleRaftVote(w http.ResponseWriter, r *http.Request) {
+	var args requestVoteArgs
+	err := json.NewDecoder(r.Body).Decode(&args)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response, _ := json.Marshal(raft.HandleRequestVote(args))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(response)
+}
+
+func handleRaftAppend(w http.ResponseWriter, r *http.Request) {
+	var args appendEntriesArgs
+	err := json.NewDecoder(r.Body).Decode(&args)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response, _ := json.Marshal(raft.HandleAppendEntries(args))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(response)
+}
+
+// raftApply is the memo state machine, IDs are assigned here so every node assigns the same ones
+func raftApply(op LogEntry) applyResult {
+	MemosMu.Lock()
+	defer MemosMu.Unlock()
+
+	if op.Method == http.MethodPost {
+		IDCount++
+		op.Memo.ID = IDCount
+	} else if op.Method == http.MethodPut {
+		if _, ok := GetMemo(op.Memo.ID); !ok {
+			return applyResult{StatusCode: http.StatusNotFound, Response: []byte("Memo not found")}
+		}
+	} else if op.Method == http.MethodPatch {
+		// the patch is laid over the memo as it is at this point of the log, applyUpdate takes the whole memo
+		current, ok := GetMemo(op.Memo.ID)
+		if !ok {
+			return applyResult{StatusCode: http.StatusNotFound, Response: []byte("Memo not found")}
+		}
+		title, body := op.Memo.Title, op.Memo.Body
+		patch := MemoPatch{}
+		for _, field := range op.Fields {
+			switch field {
+			case "title":
+				patch.Title = &title
+			case "body":
+				patch.Body = &body
+			}
+		}
+		op.Memo = patch.apply(current)
+	}
+	return ApplyEntry(op)
+}
+
+// RaftWrite proposes a client write on the leader, or forwards it to the leader from a follower
+func RaftWrite(w http.ResponseWriter, r *http.Request) {
+	_, isLeader, leader := raft.Status()
+	if !isLeader {
+		if leader == "" {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "No raft leader elected yet", http.StatusServiceUnavailable)
+			return
+		}
+		forwardToLeader(w, r, leader)
+		return
+	}
+
+	LogRequest(r, "Received ", r.Method, " request as raft leader")
+	done, answered := IdempotencyGuard(w, r)
+	if answered {
+		return
+	}
+	defer done()
+
+	op := LogEntry{Method: r.Method, Time: time.Now(), Key: r.Header.Get("Idempotency-Key")}
+	// the version is checked when the entry is applied, in log order on every node
+	base, err := parseVersion(r.Header.Get("If-Match"))
+	if err != nil {
+		http.Error(w, "If-Match does not name a memo version", http.StatusPreconditionFailed)
+		return
+	}
+	op.Base = base
+	if r.Method != http.MethodPost {
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+		op.Memo.ID = id
+	}
+	if r.Method != http.MethodDelete {
+		var requestBody map[string]string
+		err := json.NewDecoder(r.Body).Decode(&requestBody)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		op.Memo.Title = requestBody["title"]
+		op.Memo.Body = requestBody["body"]
+		if r.Method == http.MethodPatch {
+			for _, field := range []string{"title", "body"} {
+				if _, ok := requestBody[field]; ok {
+					op.Fields = append(op.Fields, field)
+				}
+			}
+		}
+	}
+
+	res, err := raft.Propose(op, 5*time.Second)
+	if err == errNotLeader {
+		_, _, leader = raft.Status()
+		if leader != "" {
+			forwardToLeader(w, r, leader)
+			return
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if res.StatusCode >= 400 {
+		http.Error(w, string(res.Response), res.StatusCode)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(res.StatusCode)
+	_, _ = w.Write(res.Response)
+}
+
+// forwardToLeader proxies a client write to the raft leader
+func forwardToLeader(w http.ResponseWriter, r *http.Request, leader string) {
+	url := "http://" + leader + r.URL.Path
+	fmt.Printf("[2023 %s] RAFT [%s] [FORWARD]    [METHOD: %s] to [%s]\n", time.Now().Format(time.StampNano), SelfAddr, r.Method, url)
+
+	ProxyRequest(w, r, url)
+}
+
+// ProxyRequest sends the client request to url as it is and copies the reply back
+func ProxyRequest(w http.ResponseWriter, r *http.Request, url string) {
+	req, err := http.NewRequest(r.Method, url, r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for h, val := range r.Header {
+		req.Header[h] = val
+	}
+
+	// the other node may itself wait for its replicas, give it longer than one replication round trip
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for h, val := range resp.Header {
+		w.Header()[h] = val
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
+
+func startRaft() {
+	var peerAddrs []string
+	for _, replica := range Config.Replicas {
+		if replica != SelfAddr {
+			peerAddrs = append(peerAddrs, replica)
+		}
+	}
+
+	raft = newRaftNode(SelfAddr, peerAddrs, &httpTransport{client: http.Client{Timeout: 100 * time.Millisecond}}, raftApply)
+	err := raft.openLog(raftLogPath())
+	if err != nil {
+		log.Fatalf("Failed to open the raft log: %s\n", err)
+	}
+	raft.Start()
+}
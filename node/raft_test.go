@@ -0,0 +1,275 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// localTransport connects raft nodes running in the same process, nodes can be cut off to simulate failures
+type localTransport struct {
+	mu    sync.Mutex
+	nodes map[string]*raftNode
+	down  map[string]bool
+}
+
+func newLocalTransport() *localTransport {
+	return &localTransport{nodes: make(map[string]*raftNode), down: make(map[string]bool)}
+}
+
+func (t *localTransport) SetDown(id string, down bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.down[id] = down
+}
+
+func (t *localTransport) target(from string, peer string) (*raftNode, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.down[from] || t.down[peer] {
+		return nil, fmt.Errorf("%s unreachable from %s", peer, from)
+	}
+	node, ok := t.nodes[peer]
+	if !ok {
+		return nil, fmt.Errorf("unknown node %s", peer)
+	}
+	return node, nil
+}
+
+// localPeer is the raftTransport one node of a localTransport cluster uses
+type localPeer struct {
+	from    string
+	cluster *localTransport
+}
+
+func (p localPeer) RequestVote(peer string, args requestVoteArgs) (requestVoteReply, error) {
+	node, err := p.cluster.target(p.from, peer)
+	if err != nil {
+		return requestVoteReply{}, err
+	}
+	return node.HandleRequestVote(args), nil
+}
+
+func (p localPeer) AppendEntries(peer string, args appendEntriesArgs) (appendEntriesReply, error) {
+	node, err := p.cluster.target(p.from, peer)
+	if err != nil {
+		return appendEntriesReply{}, err
+	}
+	return node.HandleAppendEntries(args), nil
+}
+
+// newLocalRaftCluster starts n raft nodes in this process, each applying entries through its own callback
+func newLocalRaftCluster(ids []string, apply func(id string, op LogEntry) applyResult) (*localTransport, map[string]*raftNode) {
+	cluster := newLocalTransport()
+	nodes := make(map[string]*raftNode)
+
+	for _, id := range ids {
+		var peerIDs []string
+		for _, other := range ids {
+			if other != id {
+				peerIDs = append(peerIDs, other)
+			}
+		}
+		nodeID := id
+		nodes[id] = newRaftNode(id, peerIDs, localPeer{from: id, cluster: cluster}, func(op LogEntry) applyResult {
+			return apply(nodeID, op)
+		})
+	}
+
+	cluster.mu.Lock()
+	for id, node := range nodes {
+		cluster.nodes[id] = node
+	}
+	cluster.mu.Unlock()
+
+	for _, node := range nodes {
+		node.Start()
+	}
+	return cluster, nodes
+}
+
+// TestRaftFailover runs a three node raft cluster in this process: it elects a leader, commits writes, cuts
+// the leader off, checks that the others elect a new leader and keep every committed write, then heals the
+// cluster and checks that all nodes end up with the same memos
+func TestRaftFailover(t *testing.T) {
+	ids := []string{"node-a", "node-b", "node-c"}
+
+	var stateMu sync.Mutex
+	states := make(map[string]map[int]Memo)
+	counters := make(map[string]int)
+	for _, id := range ids {
+		states[id] = make(map[int]Memo)
+	}
+
+	cluster, nodes := newLocalRaftCluster(ids, func(id string, op LogEntry) applyResult {
+		stateMu.Lock()
+		defer stateMu.Unlock()
+
+		if op.Method == http.MethodPost {
+			counters[id]++
+			op.Memo.ID = counters[id]
+		}
+		if op.Method == http.MethodDelete {
+			delete(states[id], op.Memo.ID)
+		} else {
+			states[id][op.Memo.ID] = op.Memo
+		}
+		response, _ := json.Marshal(op.Memo)
+		return applyResult{StatusCode: http.StatusOK, Response: response}
+	})
+	defer func() {
+		for _, node := range nodes {
+			node.Stop()
+		}
+	}()
+
+	waitLeader := func(exclude string) string {
+		deadline := time.Now().Add(3 * time.Second)
+		for time.Now().Before(deadline) {
+			for id, node := range nodes {
+				if _, isLeader, _ := node.Status(); isLeader && id != exclude {
+					return id
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		return ""
+	}
+
+	leader := waitLeader("")
+	if leader == "" {
+		t.Fatal("no leader elected")
+	}
+	t.Logf("%s elected", leader)
+
+	for i := 1; i <= 3; i++ {
+		_, err := nodes[leader].Propose(LogEntry{Method: http.MethodPost, Memo: Memo{Title: fmt.Sprintf("memo %d", i)}}, time.Second)
+		if err != nil {
+			t.Fatalf("write %d: %s", i, err)
+		}
+	}
+
+	cluster.SetDown(leader, true)
+	newLeader := waitLeader(leader)
+	if newLeader == "" {
+		t.Fatal("no new leader after the old one was cut off")
+	}
+	t.Logf("%s cut off, %s elected", leader, newLeader)
+
+	_, err := nodes[newLeader].Propose(LogEntry{Method: http.MethodPost, Memo: Memo{Title: "memo 4"}}, time.Second)
+	if err != nil {
+		t.Fatalf("write after failover: %s", err)
+	}
+	if _, err := nodes[leader].Propose(LogEntry{Method: http.MethodPost, Memo: Memo{Title: "lost"}}, 300*time.Millisecond); err == nil {
+		t.Fatal("the cut off leader committed a write")
+	}
+
+	cluster.SetDown(leader, false)
+	time.Sleep(time.Second)
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	for _, id := range ids {
+		if len(states[id]) != 4 {
+			t.Fatalf("%s holds %d memos, expected 4", id, len(states[id]))
+		}
+		for memoID, memo := range states[ids[0]] {
+			if !sameMemo(states[id][memoID], memo) {
+				t.Fatalf("%s disagrees on memo %d", id, memoID)
+			}
+		}
+	}
+}
+
+// TestRaftPartialPatch checks that a PATCH through the raft log keeps the fields the client left out
+func TestRaftPartialPatch(t *testing.T) {
+	Config = Configuration{Sync: "raft", Replicas: []string{"127.0.0.1:1"}}
+	SelfAddr = Config.Replicas[0]
+	MemoStore = &memoryStore{}
+	IDCount = 0
+
+	raft = newRaftNode(SelfAddr, nil, nil, raftApply)
+	raft.Start()
+	defer raft.Stop()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, isLeader, _ := raft.Status(); isLeader {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("single raft node did not become leader")
+		}
+	}
+
+	write := func(method string, id string, body string) int {
+		r := httptest.NewRequest(method, "/note/"+id, strings.NewReader(body))
+		if id != "" {
+			r = mux.SetURLVars(r, map[string]string{"id": id})
+		}
+		w := httptest.NewRecorder()
+		RaftWrite(w, r)
+		return w.Code
+	}
+	if code := write(http.MethodPost, "", `{"title":"title","body":"old body"}`); code != http.StatusCreated {
+		t.Fatalf("POST answered %d", code)
+	}
+	if code := write(http.MethodPatch, "1", `{"body":"new body"}`); code != http.StatusOK {
+		t.Fatalf("PATCH answered %d", code)
+	}
+
+	MemosMu.Lock()
+	defer MemosMu.Unlock()
+	want := Memo{ID: 1, Title: "title", Body: "new body", Version: 2}
+	if memo, _ := GetMemo(1); !sameMemo(memo, want) {
+		t.Fatalf("memo after a body-only PATCH %+v, expected %+v", memo, want)
+	}
+}
+
+// TestRaftLogRestart checks that a node restarted from its raft log keeps its term, its vote and the entries
+// it stored, and does not vote for a second candidate in the same term
+func TestRaftLogRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "raft.log")
+	peers := []string{"node-b", "node-c"}
+
+	rn := newRaftNode("node-a", peers, nil, nil)
+	if err := rn.openLog(path); err != nil {
+		t.Fatal(err)
+	}
+	if reply := rn.HandleRequestVote(requestVoteArgs{Term: 5, CandidateID: "node-b"}); !reply.VoteGranted {
+		t.Fatal("first vote in term 5 refused")
+	}
+	entry := raftEntry{Term: 5, Index: 1, Op: LogEntry{Method: http.MethodPost, Memo: Memo{Title: "memo"}}}
+	if reply := rn.HandleAppendEntries(appendEntriesArgs{Term: 5, LeaderID: "node-b", Entries: []raftEntry{entry}}); !reply.Success {
+		t.Fatal("append from the leader refused")
+	}
+	rn.logFile.Close()
+
+	// a record torn by the crash is cut off
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString(`{"term":6,"votedFor":"no`)
+	f.Close()
+
+	restarted := newRaftNode("node-a", peers, nil, nil)
+	if err := restarted.openLog(path); err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.logFile.Close()
+	if restarted.currentTerm != 5 || restarted.votedFor != "node-b" || len(restarted.log) != 2 || restarted.log[1].Op.Memo.Title != "memo" {
+		t.Fatalf("restored term %d, vote %q, log %+v", restarted.currentTerm, restarted.votedFor, restarted.log)
+	}
+	if reply := restarted.HandleRequestVote(requestVoteArgs{Term: 5, CandidateID: "node-c", LastLogIndex: 1, LastLogTerm: 5}); reply.VoteGranted {
+		t.Fatal("restarted node voted twice in term 5")
+	}
+}
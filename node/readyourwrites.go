@@ -0,0 +1,65 @@
+package node
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Read-your-writes
+
+	Every write the primary answers carries its sequence number in X-Consistency-Token. A client that sends
+	the token back on a read is served by a replica only once the replica applied that sequence number. The
+	replica waits up to readWaitTimeoutMs for it and otherwise proxies the read to the primary.
+*/
+
+func readWaitTimeout() time.Duration {
+	if Config.ReadWaitTimeoutMs <= 0 {
+		return 500 * time.Millisecond
+	}
+	return time.Duration(Config.ReadWaitTimeoutMs) * time.Millisecond
+}
+
+func SetConsistencyToken(w http.ResponseWriter, seq uint64) {
+	w.Header().Set("X-Consistency-Token", strconv.FormatUint(seq, 10))
+}
+
+// AwaitToken holds a replica read until the write behind the client's token is applied here, it returns
+// true when the read has been answered already, by the primary or with an error
+func AwaitToken(w http.ResponseWriter, r *http.Request) bool {
+	tokenStr := r.Header.Get("X-Consistency-Token")
+	if tokenStr == "" {
+		return false
+	}
+	token, err := strconv.ParseUint(tokenStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid X-Consistency-Token", http.StatusBadRequest)
+		return true
+	}
+
+	deadline := time.Now().Add(readWaitTimeout())
+	for {
+		MemosMu.Lock()
+		applied := LastSeq
+		MemosMu.Unlock()
+		if applied >= token {
+			return false
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	primaryURL, err := GetPrimaryURL()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return true
+	}
+	fmt.Printf("[2023 %s] %s SERVER [READ-YOUR-WRITES] token %d not applied after %s, reading from the primary\n", time.Now().Format(time.StampNano), Role, token, readWaitTimeout())
+	ProxyRequest(w, r, strings.TrimSuffix(primaryURL, "/note")+r.URL.Path)
+	return true
+}
@@ -0,0 +1,348 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Ordered replication
+
+	Updates from the primary carry a Replication-Seq header and are applied strictly in sequence order.
+	An update that arrives early is buffered, and if the gap is still there shortly afterwards the missing
+	entries are fetched from the primary's /replication/log. After a failover the old primary follows the
+	new one the same way. An entry the node refuses, for example with 412 because it holds another version
+	of the memo, is not recorded as applied and the refusal goes back to the sender. The node cannot get
+	past that sequence number through the log and installs the primary's snapshot instead.
+*/
+
+var (
+	PendingEntries = make(map[uint64]LogEntry)
+	gapFetching    bool
+	Ready          bool // false until the catch-up from the primary has finished
+	catchingUp     bool
+)
+
+type applyResult struct {
+	StatusCode int
+	Response   []byte
+	Mismatch   string
+}
+
+// ApplyEntry applies one update from the primary and remembers its idempotency key, it must be called
+// with memosMu held
+func ApplyEntry(entry LogEntry) applyResult {
+	res := applyUpdate(entry)
+	if res.StatusCode < 400 {
+		rememberKey(entry.Key, entry.Method, entry.Memo.ID)
+	}
+	return res
+}
+
+func applyUpdate(entry LogEntry) applyResult {
+	if current, ok := GetMemo(entry.Memo.ID); ok && entry.Method != http.MethodPost && entry.Base != 0 && current.Version != entry.Base {
+		fmt.Printf("[2023 %s] %s SERVER [PRECONDITION]   [METHOD: %s] memo %d is at version %d, update was made on %d\n", time.Now().Format(time.StampNano), Role, entry.Method, entry.Memo.ID, current.Version, entry.Base)
+		return applyResult{StatusCode: http.StatusPreconditionFailed, Response: []byte(fmt.Sprintf("Memo %d is at version %d", entry.Memo.ID, current.Version))}
+	}
+	// a refused update must not reach the document either
+	if entry.Ops != nil && entry.Method != http.MethodDelete {
+		entry.Memo = crdtApplyEntry(entry)
+	}
+	newMemo := entry.Memo
+
+	switch entry.Method {
+	case http.MethodPost:
+		// The primary is authoritative for IDs, the memo is stored under exactly the ID it assigned
+		if newMemo.ID <= 0 {
+			fmt.Printf("[2023 %s] %s SERVER [ID MISMATCH] [METHOD: %s] Rejected update without memo ID\n", time.Now().Format(time.StampNano), Role, entry.Method)
+			return applyResult{StatusCode: http.StatusBadRequest, Response: []byte("Missing primary-assigned memo ID")}
+		}
+
+		if newMemo.Version == 0 {
+			newMemo.Version = 1
+		}
+		res := applyResult{StatusCode: http.StatusCreated}
+		if current, ok := GetMemo(newMemo.ID); ok && !sameMemo(current, newMemo) {
+			// we already hold different data under this ID, the replica had diverged
+			res.Mismatch = "replaced"
+			fmt.Printf("[2023 %s] %s SERVER [ID MISMATCH] [METHOD: %s] memo %d replaced %+v with %+v\n", time.Now().Format(time.StampNano), Role, entry.Method, newMemo.ID, current, newMemo)
+		}
+		upsertMemo(newMemo)
+		if newMemo.ID > IDCount {
+			IDCount = newMemo.ID
+		}
+		res.Response, _ = json.Marshal(newMemo)
+		return res
+
+	case http.MethodPut:
+		// insert-or-replace, a PUT for a memo we never received means an earlier update was lost
+		res := applyResult{StatusCode: http.StatusOK}
+		current, ok := GetMemo(newMemo.ID)
+		if newMemo.Version == 0 {
+			newMemo.Version = 1
+			if ok {
+				newMemo.Version = current.Version + 1
+			}
+		}
+		if !ok {
+			res.Mismatch = "missing"
+			fmt.Printf("[2023 %s] %s SERVER [ID MISMATCH] [METHOD: %s] memo %d was missing, inserted\n", time.Now().Format(time.StampNano), Role, entry.Method, newMemo.ID)
+		}
+		upsertMemo(newMemo)
+		if newMemo.ID > IDCount {
+			IDCount = newMemo.ID
+		}
+		res.Response, _ = json.Marshal(newMemo)
+		return res
+
+	case http.MethodPatch:
+		// The primary sends the whole memo the patch resulted in, an empty field is an empty field
+		patch := MemoPatch{Version: newMemo.Version, Title: &newMemo.Title, Body: &newMemo.Body}
+		memo, ok := patchMemo(newMemo.ID, patch)
+		if !ok {
+			return applyResult{StatusCode: http.StatusNotFound, Response: []byte("Memo not found")}
+		}
+		response, _ := json.Marshal(memo)
+		return applyResult{StatusCode: http.StatusOK, Response: response}
+
+	case http.MethodDelete:
+		delete(crdtDocs, newMemo.ID)
+		if !removeMemo(newMemo.ID) {
+			return applyResult{StatusCode: http.StatusNotFound, Response: []byte("Memo not found")}
+		}
+		return applyResult{StatusCode: http.StatusOK, Response: []byte(`{"msg": "OK"}`)}
+	}
+
+	return applyResult{StatusCode: http.StatusMethodNotAllowed, Response: []byte("Method not allowed")}
+}
+
+// applyOrdered applies the entry if it is the next one in sequence and buffers it otherwise,
+// it must be called with memosMu held
+func applyOrdered(entry LogEntry) applyResult {
+	if entry.Seq <= LastSeq {
+		return applyResult{StatusCode: http.StatusOK, Response: []byte(`{"msg": "already applied"}`)}
+	}
+
+	if !Ready || entry.Seq > LastSeq+1 {
+		PendingEntries[entry.Seq] = entry
+		fmt.Printf("[2023 %s] %s SERVER [SEQ GAP]     [METHOD: %s] Buffered seq %d, last applied %d\n", time.Now().Format(time.StampNano), Role, entry.Method, entry.Seq, LastSeq)
+		scheduleGapFetch()
+		return applyResult{StatusCode: http.StatusAccepted, Response: []byte(`{"msg": "buffered"}`)}
+	}
+
+	res := ApplyEntry(entry)
+	if res.StatusCode >= 400 {
+		rejectEntry(entry, res)
+		return res
+	}
+	recordApplied(entry)
+	drainPending()
+	return res
+}
+
+// drainPending applies buffered entries that are now next in sequence, it must be called with memosMu held
+func drainPending() {
+	for {
+		entry, ok := PendingEntries[LastSeq+1]
+		if !ok {
+			return
+		}
+		delete(PendingEntries, entry.Seq)
+		res := ApplyEntry(entry)
+		if res.StatusCode >= 400 {
+			rejectEntry(entry, res)
+			return
+		}
+		recordApplied(entry)
+	}
+}
+
+// rejectEntry leaves a refused entry unapplied and catches up from the primary's snapshot, it must be
+// called with memosMu held
+func rejectEntry(entry LogEntry, res applyResult) {
+	fmt.Printf("[2023 %s] %s SERVER [REJECTED]    [METHOD: %s] Seq %d refused with %d: %s\n", time.Now().Format(time.StampNano), Role, entry.Method, entry.Seq, res.StatusCode, string(res.Response))
+	go catchUp()
+}
+
+// scheduleGapFetch must be called with memosMu held
+func scheduleGapFetch() {
+	if gapFetching || !Ready {
+		return
+	}
+	gapFetching = true
+
+	go func() {
+		// give the missing entries a moment to arrive on their own
+		time.Sleep(200 * time.Millisecond)
+
+		MemosMu.Lock()
+		gap := len(PendingEntries) > 0
+		from := LastSeq + 1
+		MemosMu.Unlock()
+
+		if gap {
+			err := fetchLog(from)
+			if err != nil {
+				log.Printf("Failed to fetch missing entries from seq %d: %s\n", from, err)
+			}
+		}
+
+		MemosMu.Lock()
+		gapFetching = false
+		if len(PendingEntries) > 0 {
+			scheduleGapFetch()
+		}
+		MemosMu.Unlock()
+	}()
+}
+
+// fetchLog requests log entries from the primary starting at the given sequence number and applies them in order
+func fetchLog(from uint64) error {
+	primaryURL, err := GetPrimaryURL()
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/replication/log?from=%d", strings.TrimSuffix(primaryURL, "/note"), from)
+	fmt.Printf("[2023 %s] %s SERVER [LOG FETCH]   Request to [%s]\n", time.Now().Format(time.StampNano), Role, url)
+
+	resp, err := ReplicationClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusGone {
+		// the primary no longer has these entries, start over from its snapshot
+		return installSnapshot()
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("log fetch failed: %s", resp.Status)
+	}
+	err = checkResponseEpoch(resp)
+	if err != nil {
+		return err
+	}
+
+	var fetched struct {
+		LastSeq uint64     `json:"lastSeq"`
+		Entries []LogEntry `json:"entries"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&fetched)
+	if err != nil {
+		return err
+	}
+
+	MemosMu.Lock()
+	defer MemosMu.Unlock()
+
+	for _, entry := range fetched.Entries {
+		if entry.Seq > LastSeq {
+			PendingEntries[entry.Seq] = entry
+		}
+	}
+	drainPending()
+
+	fmt.Printf("[2023 %s] %s SERVER [LOG FETCH]   Fetched %d entries, last applied %d\n", time.Now().Format(time.StampNano), Role, len(fetched.Entries), LastSeq)
+	return nil
+}
+
+// ApplyFromPrimary turns an update request from the primary into a log entry and applies it
+func ApplyFromPrimary(w http.ResponseWriter, r *http.Request) {
+	if !checkEpoch(w, r) {
+		return
+	}
+	if AmPrimary() {
+		http.Error(w, "This node is the primary", http.StatusConflict)
+		return
+	}
+
+	entry := LogEntry{Method: r.Method}
+
+	if seqStr := r.Header.Get("Replication-Seq"); seqStr != "" {
+		seq, err := strconv.ParseUint(seqStr, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid Replication-Seq", http.StatusBadRequest)
+			return
+		}
+		entry.Seq = seq
+		notePrimarySeq(seq)
+	}
+	base, err := parseVersion(r.Header.Get("If-Match"))
+	if err != nil {
+		http.Error(w, "Invalid If-Match", http.StatusBadRequest)
+		return
+	}
+	entry.Base = base
+	entry.Key = r.Header.Get("Idempotency-Key")
+
+	if r.Method != http.MethodPost {
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+		entry.Memo.ID = id
+	}
+
+	if r.Method != http.MethodDelete {
+		var body replicationBody
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		newMemo := body.Memo
+		entry.Ops = body.Ops
+		if r.Method != http.MethodPost && newMemo.ID != 0 && newMemo.ID != entry.Memo.ID {
+			http.Error(w, "Memo ID does not match the URL", http.StatusBadRequest)
+			fmt.Printf("[2023 %s] %s SERVER [ID MISMATCH] [METHOD: %s] body ID %d for memo %d\n", time.Now().Format(time.StampNano), Role, r.Method, newMemo.ID, entry.Memo.ID)
+			return
+		}
+		if r.Method != http.MethodPost {
+			newMemo.ID = entry.Memo.ID
+		}
+		entry.Memo = newMemo
+	}
+
+	MemosMu.Lock()
+	var res applyResult
+	if entry.Seq == 0 {
+		// update without ordering metadata, apply as it comes
+		res = ApplyEntry(entry)
+	} else {
+		res = applyOrdered(entry)
+	}
+	applied := LastSeq
+	MemosMu.Unlock()
+
+	if res.StatusCode >= 400 {
+		http.Error(w, string(res.Response), res.StatusCode)
+		return
+	}
+
+	// a buffered entry is not passed on, the successor fetches it from the primary, and the reply does not
+	// confirm it
+	if Config.Sync == "chain" && res.StatusCode != http.StatusAccepted {
+		if next, ok := ChainForward(entry); ok && !next.Acked() {
+			http.Error(w, "Successor in the chain failed", http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("X-Chain-Confirmed", "true")
+	}
+
+	if res.Mismatch != "" {
+		w.Header().Set("X-Id-Mismatch", res.Mismatch)
+	}
+	w.Header().Set("X-Last-Applied-Seq", strconv.FormatUint(applied, 10))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(res.StatusCode)
+	_, _ = w.Write(res.Response)
+	fmt.Printf("[2023 %s] %s SERVER [REPLY]   [METHOD: %s] Reply Update to Primary server (seq %d)\n", time.Now().Format(time.StampNano), Role, r.Method, entry.Seq)
+}
@@ -0,0 +1,63 @@
+package node
+
+import (
+	"net/http"
+	"testing"
+)
+
+// TestRejectedEntryNotRecorded checks that an entry the replica refuses is not recorded as applied, neither
+// when it arrives nor when it is drained from the buffer
+func TestRejectedEntryNotRecorded(t *testing.T) {
+	Config = Configuration{Replicas: []string{"127.0.0.1:1"}}
+	SelfAddr = Config.Replicas[0]
+	MemoStore = &memoryStore{}
+	LastSeq, ReplLog = 0, nil
+	PendingEntries = make(map[uint64]LogEntry)
+	Ready = true
+	// there is no primary to catch up from or fetch gaps from
+	catchingUp, gapFetching = true, true
+
+	MemosMu.Lock()
+	defer MemosMu.Unlock()
+	upsertMemo(Memo{ID: 1, Title: "memo", Version: 2})
+
+	stale := LogEntry{Seq: 1, Method: http.MethodPatch, Memo: Memo{ID: 1, Title: "stale", Version: 2}, Base: 1}
+	if res := applyOrdered(stale); res.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("update made on version 1 answered %d, expected 412", res.StatusCode)
+	}
+	if LastSeq != 0 || len(ReplLog) != 0 {
+		t.Fatalf("refused entry recorded, last seq %d, log %+v", LastSeq, ReplLog)
+	}
+
+	stale.Seq = 2
+	applyOrdered(stale)
+	post := LogEntry{Seq: 1, Method: http.MethodPost, Memo: Memo{ID: 2, Title: "new", Version: 1}}
+	if res := applyOrdered(post); res.StatusCode != http.StatusCreated {
+		t.Fatalf("new memo answered %d", res.StatusCode)
+	}
+	if LastSeq != 1 || len(ReplLog) != 1 {
+		t.Fatalf("buffered refused entry recorded, last seq %d, log %+v", LastSeq, ReplLog)
+	}
+	if memo, _ := GetMemo(1); memo.Title != "memo" {
+		t.Fatalf("refused entry changed the memo to %+v", memo)
+	}
+}
+
+// TestPatchToEmptyField checks that a replicated patch can empty a field, the entry carries the whole memo
+func TestPatchToEmptyField(t *testing.T) {
+	Config = Configuration{Replicas: []string{"127.0.0.1:1"}}
+	SelfAddr = Config.Replicas[0]
+	MemoStore = &memoryStore{}
+
+	MemosMu.Lock()
+	defer MemosMu.Unlock()
+	upsertMemo(Memo{ID: 1, Title: "memo", Body: "text", Version: 1})
+
+	entry := LogEntry{Method: http.MethodPatch, Memo: Memo{ID: 1, Title: "memo", Body: "", Version: 2}, Base: 1}
+	if res := ApplyEntry(entry); res.StatusCode != http.StatusOK {
+		t.Fatalf("patch answered %d: %s", res.StatusCode, res.Response)
+	}
+	if memo, _ := GetMemo(1); memo.Body != "" || memo.Title != "memo" || memo.Version != 2 {
+		t.Fatalf("memo after emptying the body %+v", memo)
+	}
+}
@@ -0,0 +1,163 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/*
+	Replication log
+
+	Every mutation on the primary gets the next sequence number while memosMu is held, so the log order is
+	exactly the order in which the changes were applied here. The number travels in the Replication-Seq header,
+	replicas apply strictly in that order and fetch missing entries from /replication/log.
+*/
+
+type LogEntry struct {
+	Seq    uint64    `json:"seq"`
+	Method string    `json:"method"`
+	Memo   Memo      `json:"memo"`
+	Time   time.Time `json:"time"`
+	Ops    *crdtOps  `json:"ops,omitempty"`    // CRDT memos only
+	Base   uint64    `json:"base,omitempty"`   // version the update was made on, 0 for any
+	Key    string    `json:"key,omitempty"`    // Idempotency-Key of the client request
+	Fields []string  `json:"fields,omitempty"` // fields a raft PATCH sets, the others keep their value
+}
+
+// ReplicationClient carries updates between the nodes, a node that stops answering fails the request after
+// the timeout instead of holding up the write
+var ReplicationClient = http.Client{Timeout: 2 * time.Second}
+
+// updates a node did not acknowledge are sent again, backing off exponentially between these bounds
+const (
+	MinRetryBackoff = 100 * time.Millisecond
+	MaxRetryBackoff = 30 * time.Second
+)
+
+var (
+	ReplLog  []LogEntry
+	LastSeq  uint64
+	LogStart uint64 = 1 // first sequence number replLog can serve, earlier ones need a snapshot
+)
+
+// AppendLog must be called with memosMu held
+func AppendLog(r *http.Request, newMemo Memo) LogEntry {
+	method := r.Method
+	entry := LogEntry{Seq: LastSeq + 1, Method: method, Memo: newMemo, Time: time.Now(), Key: r.Header.Get("Idempotency-Key")}
+	entry.Ops = crdtRecord(method, newMemo.ID)
+	entry.Base = baseVersion(method, newMemo)
+	rememberKey(entry.Key, method, newMemo.ID)
+	recordApplied(entry)
+	return entry
+}
+
+// recordApplied must be called with memosMu held
+func recordApplied(entry LogEntry) {
+	walAppend(entry)
+	LastSeq = entry.Seq
+	ReplLog = append(ReplLog, entry)
+	publishProgress()
+}
+
+// getReplicationLog returns every log entry from the "from" sequence number on
+func getReplicationLog(w http.ResponseWriter, r *http.Request) {
+	from, err := strconv.ParseUint(r.URL.Query().Get("from"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid from sequence", http.StatusBadRequest)
+		return
+	}
+
+	MemosMu.Lock()
+	if from < LogStart {
+		MemosMu.Unlock()
+		http.Error(w, "Log truncated, fetch a snapshot", http.StatusGone)
+		return
+	}
+	entries := []LogEntry{}
+	for _, entry := range ReplLog {
+		if entry.Seq >= from {
+			entries = append(entries, entry)
+		}
+	}
+	response, err := json.Marshal(map[string]interface{}{
+		"lastSeq": LastSeq,
+		"entries": entries,
+	})
+	MemosMu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("X-Primary-Epoch", strconv.FormatUint(currentEpoch(), 10))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(response)
+	fmt.Printf("[2023 %s] %s SERVER [LOG FETCH]      [METHOD: %s] %d entries from seq %d\n", time.Now().Format(time.StampNano), Role, r.Method, len(entries), from)
+}
+
+// getSnapshot returns a consistent copy of every memo together with the sequence number it reflects,
+// a replica that (re)joins installs it and then fetches the log from the next sequence number on
+func getSnapshot(w http.ResponseWriter, r *http.Request) {
+	MemosMu.Lock()
+	response, err := json.Marshal(currentSnapshot(AllMemos()))
+	seq := LastSeq
+	MemosMu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("X-Primary-Epoch", strconv.FormatUint(currentEpoch(), 10))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(response)
+	fmt.Printf("[2023 %s] %s SERVER [SNAPSHOT]       [METHOD: %s] Sent snapshot at seq %d\n", time.Now().Format(time.StampNano), Role, r.Method, seq)
+}
+
+// SendEntry delivers one log entry to another node in the format applyFromPrimary expects
+func SendEntry(addr string, entry LogEntry) ReplicaResult {
+	url := "http://" + addr + "/note"
+	if entry.Method != http.MethodPost {
+		url = fmt.Sprintf("%s/%d", url, entry.Memo.ID)
+	}
+	res := ReplicaResult{URL: url}
+
+	var data []byte
+	if entry.Method != http.MethodDelete {
+		data, _ = json.Marshal(replicationBody{Memo: entry.Memo, Ops: entry.Ops})
+	}
+
+	req, err := http.NewRequest(entry.Method, url, bytes.NewReader(data))
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	req.Header.Set("From-Primary", "true")
+	req.Header.Set("Replication-Seq", strconv.FormatUint(entry.Seq, 10))
+	if entry.Base != 0 {
+		req.Header.Set("If-Match", fmt.Sprintf("\"%d\"", entry.Base))
+	}
+	if entry.Key != "" {
+		req.Header.Set("Idempotency-Key", entry.Key)
+	}
+	SetEpochHeaders(req)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := ReplicationClient.Do(req)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	resp.Body.Close()
+	res.StatusCode = resp.StatusCode
+	res.Mismatch = resp.Header.Get("X-Id-Mismatch")
+	res.AppliedSeq, _ = strconv.ParseUint(resp.Header.Get("X-Last-Applied-Seq"), 10, 64)
+	res.Confirmed = resp.Header.Get("X-Chain-Confirmed") == "true"
+	ObserveRejection(resp)
+	return res
+}
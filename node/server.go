@@ -0,0 +1,161 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+	Startup
+
+	Both servers load config.json, recover their memos, find the primary and serve the cluster endpoints the
+	same way. Only the client-facing /note handlers and how a write reaches the other nodes differ between
+	primary.go and replica.go.
+*/
+
+// LoadConfig reads config.json and checks it, index is this node's entry in config.Replicas
+func LoadConfig(path string, index int) {
+	configData, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Error reading the config file: %s\n", err)
+	}
+
+	err = json.Unmarshal(configData, &Config)
+	if err != nil {
+		log.Fatalf("Error decoding the config JSON: %s\n", err)
+	}
+	if len(Config.Replicas) == 0 {
+		log.Fatalf("Invalid config.json file: no replicas\n")
+	}
+	if index < 0 || index >= len(Config.Replicas) {
+		log.Fatalf("Invalid replica index %d for %d replicas in config.json\n", index, len(Config.Replicas))
+	}
+	selfIndex = index
+	SelfAddr = Config.Replicas[index]
+
+	if Config.Sync == "multi-primary" && conflictPolicy() != "lww" && conflictPolicy() != "siblings" {
+		log.Fatalf("Invalid conflictPolicy %q, use lww or siblings\n", Config.ConflictPolicy)
+	}
+	if policy := walSyncPolicy(); policy != "always" && policy != "batched" && policy != "none" {
+		log.Fatalf("Invalid walSync %q, use always, batched or none\n", Config.WALSync)
+	}
+	// the write-ahead log would silently stay empty and acknowledged writes would not be on disk
+	if Config.WALDir != "" && !keepsLog() {
+		log.Fatalf("walDir is not supported in %s mode, it keeps no replication log to write ahead\n", Config.Sync)
+	}
+	if leasesEnabled() && len(Config.Replicas) < 3 {
+		log.Fatalf("leaseMs needs at least 3 nodes, with %d the lease majority is lost together with the primary\n", len(Config.Replicas))
+	}
+	// lastApplied lives in memory, a restarted node applies its whole raft log again and would apply every
+	// write a second time on top of memos a durable store kept
+	if Config.Sync == "raft" && StoreKind() != "memory" {
+		log.Fatalf("Store %q is not supported in raft mode, use the memory store\n", StoreKind())
+	}
+}
+
+// Recover opens the store and replays the write-ahead log
+func Recover() {
+	var err error
+	MemoStore, err = openStore(StoreKind(), storeDir())
+	if err != nil {
+		log.Fatalf("Failed to open the %s store: %s\n", StoreKind(), err)
+	}
+
+	replayWAL()
+	// a durable store may hold memos the write-ahead log does not know about, new IDs must not collide with them
+	MemosMu.Lock()
+	if memos := AllMemos(); len(memos) > 0 && memos[len(memos)-1].ID > IDCount {
+		IDCount = memos[len(memos)-1].ID
+	}
+	MemosMu.Unlock()
+	if walEnabled() {
+		if walSyncPolicy() == "batched" {
+			go runWALSync()
+		}
+		go runSnapshots()
+	}
+}
+
+// hasPrimary tells whether the mode has a single primary the other nodes follow
+func hasPrimary() bool {
+	return Config.Sync != "local-write" && Config.Sync != "quorum" && Config.Sync != "multi-primary" && Config.Sync != "raft"
+}
+
+// Join takes primary as the primary unless another node already acts as one, a node that is not the primary
+// catches up with it first. Modes without a single primary are ready at once.
+func Join(primary string) {
+	CurrentPrimary = primary
+	if hasPrimary() {
+		if found, foundTerm, ok := discoverPrimary(); ok {
+			// a failover happened while we were gone, rejoin as a replica of the new primary
+			CurrentPrimary, term = found, foundTerm
+		}
+	}
+	isPrimary = CurrentPrimary == SelfAddr
+	fmt.Printf("Primary: %s (term %d)\n", CurrentPrimary, term)
+
+	MemosMu.Lock()
+	Ready = isPrimary || !hasPrimary()
+	publishProgress()
+	MemosMu.Unlock()
+	if !Ready {
+		go catchUp()
+	}
+}
+
+// Start runs the background work of the configured mode
+func Start() {
+	if Config.Sync == "atomic" {
+		recoverTransactions()
+		go resolveInDoubt()
+	}
+	switch {
+	case Config.Sync == "raft":
+		startRaft()
+	case Config.Sync == "multi-primary":
+		go runMultiSync()
+	case hasPrimary():
+		// chain nodes forward to their successor themselves
+		if Config.Sync != "chain" {
+			startReplicators()
+		}
+		go sendHeartbeats()
+		go runAntiEntropy()
+		if leasesEnabled() {
+			go renewLease()
+		}
+	}
+}
+
+// RegisterHandlers adds every endpoint the nodes use among themselves
+func RegisterHandlers(router *mux.Router) {
+	router.HandleFunc("/replication/log", getReplicationLog).Methods(http.MethodGet)
+	router.HandleFunc("/admin/replication", replicationQueues).Methods(http.MethodGet)
+	router.HandleFunc("/replication/snapshot", getSnapshot).Methods(http.MethodGet)
+	router.HandleFunc("/admin/fencing", fencingStatus).Methods(http.MethodGet)
+	router.HandleFunc("/admin/lease", leaseStatus).Methods(http.MethodGet)
+	router.HandleFunc("/admin/snapshot", snapshotStatus).Methods(http.MethodGet, http.MethodPost)
+	router.HandleFunc("/cluster/lease", handleLease).Methods(http.MethodPost)
+	router.HandleFunc("/cluster/heartbeat", handleHeartbeat).Methods(http.MethodGet)
+	router.HandleFunc("/cluster/primary", handleAnnounce).Methods(http.MethodPost)
+	router.HandleFunc("/raft/vote", handleRaftVote).Methods(http.MethodPost)
+	router.HandleFunc("/raft/append", handleRaftAppend).Methods(http.MethodPost)
+	router.HandleFunc("/handover/{id}", handOver).Methods(http.MethodPost)
+	router.HandleFunc("/owner-update/{id}", applyOwnerUpdate).Methods(http.MethodPut, http.MethodDelete)
+	router.HandleFunc("/quorum/store", handleQuorumList).Methods(http.MethodGet)
+	router.HandleFunc("/multi/update", handleMultiUpdate).Methods(http.MethodPost)
+	router.HandleFunc("/multi/store", handleMultiStore).Methods(http.MethodGet)
+	router.HandleFunc("/crdt/doc/{id}", handleCRDTDoc).Methods(http.MethodGet)
+	router.HandleFunc("/antientropy/tree", handleMerkle).Methods(http.MethodGet)
+	router.HandleFunc("/admin/antientropy", antiEntropyStatus).Methods(http.MethodGet)
+	router.HandleFunc("/2pc/prepare", handlePrepare).Methods(http.MethodPost)
+	router.HandleFunc("/2pc/commit", handleDecision("committed")).Methods(http.MethodPost)
+	router.HandleFunc("/2pc/abort", handleDecision("aborted")).Methods(http.MethodPost)
+	router.HandleFunc("/2pc/status/{tx}", handleTxStatus).Methods(http.MethodGet)
+	router.HandleFunc("/quorum/store/{id}", handleQuorumStore).Methods(http.MethodGet, http.MethodPut)
+}
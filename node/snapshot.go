@@ -0,0 +1,324 @@
+package node
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/*
+	Snapshots and log compaction
+
+	A snapshot is the full memo set together with the last applied sequence number, written to
+	walDir/snap-<node>-<seq>.json behind a SHA-256 of its contents. The node takes one every
+	snapshotIntervalMs (60000 by default) or once snapshotEntries (1000 by default) entries were logged since
+	the last one, whichever comes first, and on POST /admin/snapshot. Taking a snapshot starts a new log
+	segment, and once the snapshot is durable the older segments and snapshots are deleted and the
+	replication log in memory is truncated, a replica that still needs those entries installs a snapshot
+	from this node instead. Installing a snapshot from the primary replaces the local files the same way.
+	GET /admin/snapshot reports the sizes and timings of the latest snapshot and of the startup replay.
+*/
+
+// snapshotInfo describes one snapshot this node wrote or loaded
+type snapshotInfo struct {
+	Seq        uint64    `json:"seq"`
+	Memos      int       `json:"memos"`
+	Bytes      int       `json:"bytes"`
+	DurationMs float64   `json:"durationMs"`
+	Reason     string    `json:"reason,omitempty"` // interval, entries, admin, install or load
+	Removed    int       `json:"removedFiles"`
+	At         time.Time `json:"at"`
+}
+
+// walReplay describes how this node rebuilt its state on startup
+type walReplay struct {
+	Snapshot      uint64  `json:"snapshotSeq"`
+	SnapshotBytes int     `json:"snapshotBytes"`
+	Replayed      int     `json:"replayedEntries"`
+	DurationMs    float64 `json:"durationMs"`
+}
+
+var (
+	snapshotMu     sync.Mutex   // serializes snapshots, taken before memosMu
+	lastSnapshot   snapshotInfo // guarded by memosMu
+	snapshotsTaken int          // guarded by memosMu
+	walStartup     walReplay
+)
+
+func snapshotInterval() time.Duration {
+	if Config.SnapshotIntervalMs <= 0 {
+		return time.Minute
+	}
+	return time.Duration(Config.SnapshotIntervalMs) * time.Millisecond
+}
+
+func snapshotEntries() int {
+	if Config.SnapshotEntries <= 0 {
+		return 1000
+	}
+	return Config.SnapshotEntries
+}
+
+func msSince(t time.Time) float64 {
+	return float64(time.Since(t).Microseconds()) / 1000
+}
+
+// writeSnapshot stores the encoded snapshot durably and then deletes every other snapshot and every segment
+// but the current one, it returns the size of the file and the number of files deleted
+func writeSnapshot(seq uint64, data []byte) (int, int, error) {
+	sum := sha256.Sum256(data)
+	content := append([]byte(hex.EncodeToString(sum[:])+"\n"), data...)
+
+	tmp := snapshotPath(seq) + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, 0, err
+	}
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmp, snapshotPath(seq))
+	}
+	if err == nil {
+		err = syncDir(Config.WALDir)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, 0, err
+	}
+
+	walMu.Lock()
+	current := walSegment
+	walMu.Unlock()
+	removed := 0
+	for _, other := range walFiles("snap", ".json") {
+		if other != seq && os.Remove(snapshotPath(other)) == nil {
+			removed++
+		}
+	}
+	for _, first := range walFiles("wal", ".log") {
+		if first != current && os.Remove(segmentPath(first)) == nil {
+			removed++
+		}
+	}
+	return len(content), removed, nil
+}
+
+// readSnapshot returns the snapshot in the file if its checksum matches
+func readSnapshot(seq uint64) (snapshotState, int, error) {
+	var snapshot snapshotState
+	content, err := ioutil.ReadFile(snapshotPath(seq))
+	if err != nil {
+		return snapshot, 0, err
+	}
+	i := bytes.IndexByte(content, '\n')
+	if i < 0 {
+		return snapshot, 0, fmt.Errorf("no checksum")
+	}
+	sum := sha256.Sum256(content[i+1:])
+	if hex.EncodeToString(sum[:]) != string(content[:i]) {
+		return snapshot, 0, fmt.Errorf("checksum mismatch")
+	}
+	err = json.Unmarshal(content[i+1:], &snapshot)
+	if err != nil {
+		return snapshot, 0, err
+	}
+	if snapshot.Seq != seq {
+		return snapshot, 0, fmt.Errorf("holds seq %d", snapshot.Seq)
+	}
+	return snapshot, len(content), nil
+}
+
+// loadSnapshot restores the newest snapshot that is intact, it must be called with memosMu held
+func loadSnapshot() {
+	seqs := walFiles("snap", ".json")
+	for i := len(seqs) - 1; i >= 0; i-- {
+		snapshot, size, err := readSnapshot(seqs[i])
+		if err != nil {
+			fmt.Printf("[2023 %s] %s SERVER [SNAPSHOT]       Skipped %s: %s\n", time.Now().Format(time.StampNano), Role, snapshotPath(seqs[i]), err)
+			continue
+		}
+		restoreSnapshot(snapshot)
+		lastSnapshot = snapshotInfo{Seq: snapshot.Seq, Memos: len(snapshot.Memos), Bytes: size, Reason: "load", At: time.Now()}
+		return
+	}
+}
+
+// compactLog drops the entries the snapshot covers from the replication log, it must be called with
+// memosMu held
+func compactLog(seq uint64) {
+	i := 0
+	for i < len(ReplLog) && ReplLog[i].Seq <= seq {
+		i++
+	}
+	ReplLog = append([]LogEntry{}, ReplLog[i:]...)
+	if seq+1 > LogStart {
+		LogStart = seq + 1
+	}
+}
+
+// takeSnapshot writes the current memos to a snapshot file and compacts the log up to it
+func takeSnapshot(reason string) (snapshotInfo, error) {
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+
+	started := time.Now()
+	MemosMu.Lock()
+	memos, err := MemoStore.Snapshot()
+	if err != nil {
+		MemosMu.Unlock()
+		return snapshotInfo{}, err
+	}
+	snapshot := currentSnapshot(memos)
+	data, err := json.Marshal(snapshot)
+	if err == nil {
+		// entries logged from here on belong to the next segment
+		err = walRotate(snapshot.Seq + 1)
+	}
+	MemosMu.Unlock()
+	if err != nil {
+		return snapshotInfo{}, err
+	}
+
+	size, removed, err := writeSnapshot(snapshot.Seq, data)
+	if err != nil {
+		return snapshotInfo{}, err
+	}
+	info := snapshotInfo{Seq: snapshot.Seq, Memos: len(snapshot.Memos), Bytes: size, DurationMs: msSince(started), Reason: reason, Removed: removed, At: time.Now()}
+
+	MemosMu.Lock()
+	compactLog(snapshot.Seq)
+	lastSnapshot = info
+	snapshotsTaken++
+	MemosMu.Unlock()
+
+	fmt.Printf("[2023 %s] %s SERVER [SNAPSHOT]       %s snapshot at seq %d, %d memos, %d bytes in %.1fms, removed %d files\n", time.Now().Format(time.StampNano), Role, reason, info.Seq, info.Memos, info.Bytes, info.DurationMs, info.Removed)
+	return info, nil
+}
+
+// saveInstalledSnapshot replaces the local files with a snapshot installed from the primary, it must be
+// called with snapshotMu and memosMu held
+func saveInstalledSnapshot(snapshot snapshotState) error {
+	if !walEnabled() {
+		return nil
+	}
+	started := time.Now()
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	err = walRotate(snapshot.Seq + 1)
+	if err != nil {
+		return err
+	}
+	size, removed, err := writeSnapshot(snapshot.Seq, data)
+	if err != nil {
+		return err
+	}
+	lastSnapshot = snapshotInfo{Seq: snapshot.Seq, Memos: len(snapshot.Memos), Bytes: size, DurationMs: msSince(started), Reason: "install", Removed: removed, At: time.Now()}
+	snapshotsTaken++
+	return nil
+}
+
+// runSnapshots takes a snapshot once enough entries were logged or the interval passed since the last one
+func runSnapshots() {
+	since := time.Now()
+	for {
+		time.Sleep(time.Second)
+
+		MemosMu.Lock()
+		if lastSnapshot.At.After(since) {
+			since = lastSnapshot.At
+		}
+		pending := int(LastSeq) - int(lastSnapshot.Seq)
+		MemosMu.Unlock()
+
+		if pending <= 0 || (pending < snapshotEntries() && time.Since(since) < snapshotInterval()) {
+			continue
+		}
+		reason := "interval"
+		if pending >= snapshotEntries() {
+			reason = "entries"
+		}
+		_, err := takeSnapshot(reason)
+		if err != nil {
+			log.Printf("Failed to take a snapshot: %s\n", err)
+		}
+		since = time.Now()
+	}
+}
+
+// snapshotStatus serves /admin/snapshot: POST takes a snapshot now, GET reports the latest one, the startup
+// replay and the files on disk
+func snapshotStatus(w http.ResponseWriter, r *http.Request) {
+	if !walEnabled() {
+		http.Error(w, "Snapshots need walDir and a mode with a replication log", http.StatusConflict)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		info, err := takeSnapshot("admin")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		response, _ := json.Marshal(info)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(response)
+		return
+	}
+
+	type diskFile struct {
+		File  string `json:"file"`
+		Seq   uint64 `json:"seq"`
+		Bytes int64  `json:"bytes"`
+	}
+	var segments, snapshots []diskFile
+	for _, first := range walFiles("wal", ".log") {
+		if info, err := os.Stat(segmentPath(first)); err == nil {
+			segments = append(segments, diskFile{File: filepath.Base(segmentPath(first)), Seq: first, Bytes: info.Size()})
+		}
+	}
+	for _, seq := range walFiles("snap", ".json") {
+		if info, err := os.Stat(snapshotPath(seq)); err == nil {
+			snapshots = append(snapshots, diskFile{File: filepath.Base(snapshotPath(seq)), Seq: seq, Bytes: info.Size()})
+		}
+	}
+
+	MemosMu.Lock()
+	response, err := json.Marshal(map[string]interface{}{
+		"walDir":         Config.WALDir,
+		"walSync":        walSyncPolicy(),
+		"lastSeq":        LastSeq,
+		"logStart":       LogStart,
+		"logEntries":     len(ReplLog),
+		"sinceSnapshot":  int(LastSeq) - int(lastSnapshot.Seq),
+		"snapshotsTaken": snapshotsTaken,
+		"latest":         lastSnapshot,
+		"startup":        walStartup,
+		"segments":       segments,
+		"snapshots":      snapshots,
+	})
+	MemosMu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(response)
+}
@@ -0,0 +1,135 @@
+package node
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Bounded staleness
+
+	A replica tracks how far it is behind the primary: in sequence numbers, from the highest primary
+	sequence number it heard of in heartbeats and updates, and in time, since it last knew that it had
+	everything the primary had. Replica reads carry both in X-Replica-Lag. A read with a Max-Staleness
+	header or max-staleness query parameter is forwarded to the primary when the replica is further behind
+	than that. The limit is a time (milliseconds, or a duration such as 2s) or has the form of X-Replica-Lag,
+	"seq=0" or "seq=5; ms=500", to bound the entries the replica may miss as well.
+*/
+
+// staleness is the lag a client accepts, a limit that is not set accepts any lag
+type staleness struct {
+	seq    uint64
+	time   time.Duration
+	hasSeq bool
+	hasMs  bool
+}
+
+var (
+	primarySeqSeen uint64    // highest sequence number the primary is known to have, guarded by clusterMu
+	syncedAt       time.Time // when this node last had everything the primary had, guarded by clusterMu
+)
+
+// notePrimarySeq records that the primary has reached seq
+func notePrimarySeq(seq uint64) {
+	clusterMu.Lock()
+	defer clusterMu.Unlock()
+
+	if seq > primarySeqSeen {
+		primarySeqSeen = seq
+	}
+	if nodeSeq >= primarySeqSeen {
+		syncedAt = time.Now()
+	}
+}
+
+// replicaLag returns how many entries and how much time this node is behind the primary
+func replicaLag() (uint64, time.Duration) {
+	clusterMu.Lock()
+	defer clusterMu.Unlock()
+
+	var seqLag uint64
+	if primarySeqSeen > nodeSeq {
+		seqLag = primarySeqSeen - nodeSeq
+	}
+	since := syncedAt
+	if since.IsZero() {
+		since = startedAt
+	}
+	return seqLag, time.Since(since)
+}
+
+func parseStaleness(value string) (staleness, error) {
+	var limit staleness
+	if !strings.Contains(value, "=") {
+		var err error
+		limit.hasMs = true
+		if ms, convErr := strconv.Atoi(value); convErr == nil {
+			limit.time = time.Duration(ms) * time.Millisecond
+		} else {
+			limit.time, err = time.ParseDuration(value)
+		}
+		return limit, err
+	}
+
+	for _, part := range strings.Split(value, ";") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return limit, fmt.Errorf("invalid max-staleness %q", value)
+		}
+		n, err := strconv.ParseUint(kv[1], 10, 64)
+		if err != nil {
+			return limit, err
+		}
+		switch kv[0] {
+		case "seq":
+			limit.seq, limit.hasSeq = n, true
+		case "ms":
+			limit.time, limit.hasMs = time.Duration(n)*time.Millisecond, true
+		default:
+			return limit, fmt.Errorf("invalid max-staleness %q", value)
+		}
+	}
+	return limit, nil
+}
+
+// exceeds tells whether a replica that lags seqLag entries and timeLag behind the primary is too stale
+func (limit staleness) exceeds(seqLag uint64, timeLag time.Duration) bool {
+	return (limit.hasSeq && seqLag > limit.seq) || (limit.hasMs && timeLag > limit.time)
+}
+
+// BoundedRead advertises the lag of a replica read and sends the read to the primary when the replica is
+// staler than the client allows, it returns true when the read has been answered already
+func BoundedRead(w http.ResponseWriter, r *http.Request) bool {
+	if AmPrimary() {
+		return false
+	}
+	seqLag, timeLag := replicaLag()
+
+	maxStaleness := r.Header.Get("Max-Staleness")
+	if maxStaleness == "" {
+		maxStaleness = r.URL.Query().Get("max-staleness")
+	}
+	if maxStaleness != "" {
+		limit, err := parseStaleness(maxStaleness)
+		if err != nil {
+			http.Error(w, "Invalid max-staleness", http.StatusBadRequest)
+			return true
+		}
+		if limit.exceeds(seqLag, timeLag) {
+			primaryURL, err := GetPrimaryURL()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return true
+			}
+			fmt.Printf("[2023 %s] %s SERVER [STALE READ]     [METHOD: %s] %d entries and %s behind, over %s, reading from the primary\n", time.Now().Format(time.StampNano), Role, r.Method, seqLag, timeLag.Round(time.Millisecond), maxStaleness)
+			ProxyRequest(w, r, strings.TrimSuffix(primaryURL, "/note")+r.URL.Path)
+			return true
+		}
+	}
+
+	w.Header().Set("X-Replica-Lag", fmt.Sprintf("seq=%d; ms=%d", seqLag, timeLag.Milliseconds()))
+	return false
+}
@@ -0,0 +1,42 @@
+package node
+
+import (
+	"testing"
+	"time"
+)
+
+// TestStalenessSeqLimit checks that a replica that heard of entries it has not applied yet is too stale for a
+// sequence bound, however recently it was in sync
+func TestStalenessSeqLimit(t *testing.T) {
+	clusterMu.Lock()
+	nodeSeq, primarySeqSeen, syncedAt = 4, 0, time.Time{}
+	clusterMu.Unlock()
+	notePrimarySeq(4)
+	notePrimarySeq(6)
+	seqLag, timeLag := replicaLag()
+	if seqLag != 2 {
+		t.Fatalf("seq lag is %d, expected 2", seqLag)
+	}
+
+	for value, stale := range map[string]bool{
+		"1s":             false,
+		"seq=0":          true,
+		"seq=2":          false,
+		"seq=5; ms=1000": false,
+		"seq=1; ms=1000": true,
+	} {
+		limit, err := parseStaleness(value)
+		if err != nil {
+			t.Fatalf("parseStaleness(%q): %s", value, err)
+		}
+		if limit.exceeds(seqLag, timeLag) != stale {
+			t.Fatalf("max-staleness %q with %d entries and %s behind: stale should be %v", value, seqLag, timeLag, stale)
+		}
+	}
+
+	for _, value := range []string{"seq=", "lag=1", "soon"} {
+		if _, err := parseStaleness(value); err == nil {
+			t.Fatalf("parseStaleness(%q) accepted an invalid limit", value)
+		}
+	}
+}
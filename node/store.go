@@ -0,0 +1,640 @@
+package node
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/*
+	Storage backends ("store": "memory", "file" or "kv")
+
+	Every memo lives in a Store, callers hold memosMu around each use. "memory" keeps the memos in a slice
+	ordered by ID and loses them on restart. "file" keeps the same slice and appends every change to
+	storeDir/memos-<node>.log, it replays the file when it opens and rewrites it with only the live memos on
+	every snapshot. "kv" is a small embedded key-value store after the Bitcask design: every change is
+	appended to storeDir/memos-<node>.kv as a checksummed record, an index in memory points at the latest
+	record of each memo, values are read from the file, and a snapshot merges the file down to the live
+	records. Both files are fsynced on every write and a torn record at their end is cut off when they open.
+	A store that fails stops the node, like the write-ahead log does, except in addMemo which answers 500.
+	TestStoreConformance checks every backend against the same suite.
+*/
+
+// Store holds the memos of one node, ordered by ID
+type Store interface {
+	Get(id int) (Memo, bool, error)
+	List() ([]Memo, error)
+	Create(memo Memo) error // errMemoExists when the ID is taken
+	Put(memo Memo) error    // insert or replace
+	Patch(id int, patch MemoPatch) (Memo, bool, error)
+	Delete(id int) (bool, error)
+	Snapshot() ([]Memo, error) // every memo, the backend compacts its files on the way
+	Restore(memos []Memo) error
+	Close() error
+}
+
+// MemoPatch changes the fields that are set, a zero Version raises the current one by one
+type MemoPatch struct {
+	Title   *string
+	Body    *string
+	Version uint64
+}
+
+func (p MemoPatch) apply(memo Memo) Memo {
+	if p.Title != nil {
+		memo.Title = *p.Title
+	}
+	if p.Body != nil {
+		memo.Body = *p.Body
+	}
+	if p.Version != 0 {
+		memo.Version = p.Version
+	} else {
+		memo.Version++
+	}
+	return memo
+}
+
+var (
+	MemoStore     Store // guarded by memosMu
+	errMemoExists = fmt.Errorf("memo ID already exists")
+)
+
+func StoreKind() string {
+	if Config.Store == "" {
+		return "memory"
+	}
+	return Config.Store
+}
+
+func storeDir() string {
+	if Config.StoreDir == "" {
+		return "."
+	}
+	return Config.StoreDir
+}
+
+// openStore opens the backend of the given kind, file and kv keep their data in dir
+func openStore(kind string, dir string) (Store, error) {
+	node := strings.Replace(SelfAddr, ":", "_", -1)
+	if kind == "file" || kind == "kv" {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch kind {
+	case "memory":
+		return &memoryStore{}, nil
+	case "file":
+		return openFileStore(filepath.Join(dir, "memos-"+node+".log"))
+	case "kv":
+		return openKVStore(filepath.Join(dir, "memos-"+node+".kv"))
+	}
+	return nil, fmt.Errorf("unknown store %q, use memory, file or kv", kind)
+}
+
+func storeFailed(err error) {
+	log.Fatalf("The %s store failed: %s\n", StoreKind(), err)
+}
+
+// GetMemo must be called with memosMu held
+func GetMemo(id int) (Memo, bool) {
+	memo, ok, err := MemoStore.Get(id)
+	if err != nil {
+		storeFailed(err)
+	}
+	return memo, ok
+}
+
+// AllMemos must be called with memosMu held
+func AllMemos() []Memo {
+	memos, err := MemoStore.List()
+	if err != nil {
+		storeFailed(err)
+	}
+	return memos
+}
+
+// patchMemo must be called with memosMu held
+func patchMemo(id int, patch MemoPatch) (Memo, bool) {
+	memo, ok, err := MemoStore.Patch(id, patch)
+	if err != nil {
+		storeFailed(err)
+	}
+	return memo, ok
+}
+
+// memoryStore is the "memory" backend, and the view the "file" backend keeps of its file
+type memoryStore struct {
+	memos []Memo
+}
+
+func (s *memoryStore) find(id int) (int, bool) {
+	i := sort.Search(len(s.memos), func(i int) bool { return s.memos[i].ID >= id })
+	return i, i < len(s.memos) && s.memos[i].ID == id
+}
+
+func (s *memoryStore) Get(id int) (Memo, bool, error) {
+	if i, ok := s.find(id); ok {
+		return s.memos[i], true, nil
+	}
+	return Memo{}, false, nil
+}
+
+func (s *memoryStore) List() ([]Memo, error) {
+	return append([]Memo{}, s.memos...), nil
+}
+
+func (s *memoryStore) Create(memo Memo) error {
+	if _, ok := s.find(memo.ID); ok {
+		return errMemoExists
+	}
+	return s.Put(memo)
+}
+
+func (s *memoryStore) Put(memo Memo) error {
+	i, ok := s.find(memo.ID)
+	if ok {
+		s.memos[i] = memo
+		return nil
+	}
+	s.memos = append(s.memos, Memo{})
+	copy(s.memos[i+1:], s.memos[i:])
+	s.memos[i] = memo
+	return nil
+}
+
+func (s *memoryStore) Patch(id int, patch MemoPatch) (Memo, bool, error) {
+	i, ok := s.find(id)
+	if !ok {
+		return Memo{}, false, nil
+	}
+	s.memos[i] = patch.apply(s.memos[i])
+	return s.memos[i], true, nil
+}
+
+func (s *memoryStore) Delete(id int) (bool, error) {
+	i, ok := s.find(id)
+	if ok {
+		s.memos = append(s.memos[:i], s.memos[i+1:]...)
+	}
+	return ok, nil
+}
+
+func (s *memoryStore) Snapshot() ([]Memo, error) {
+	return s.List()
+}
+
+func (s *memoryStore) Restore(memos []Memo) error {
+	s.memos = append([]Memo{}, memos...)
+	sort.Slice(s.memos, func(i, j int) bool { return s.memos[i].ID < s.memos[j].ID })
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// fileRecord is one line of the "file" backend
+type fileRecord struct {
+	Op   string `json:"op"` // put or delete
+	Memo Memo   `json:"memo"`
+}
+
+// fileStore is the "file" backend
+type fileStore struct {
+	memoryStore
+	path string
+	file *os.File
+}
+
+func openFileStore(path string) (*fileStore, error) {
+	s := &fileStore{path: path}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	offset := 0
+	for offset < len(data) {
+		end := bytes.IndexByte(data[offset:], '\n')
+		var rec fileRecord
+		if end < 0 || json.Unmarshal(data[offset:offset+end], &rec) != nil {
+			break
+		}
+		if rec.Op == "delete" {
+			s.memoryStore.Delete(rec.Memo.ID)
+		} else {
+			s.memoryStore.Put(rec.Memo)
+		}
+		offset += end + 1
+	}
+
+	s.file, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err == nil && offset < len(data) {
+		// cut off the torn record so that new records follow the last complete one
+		err = s.file.Truncate(int64(offset))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileStore) write(rec fileRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = s.file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+func (s *fileStore) Create(memo Memo) error {
+	if _, ok := s.find(memo.ID); ok {
+		return errMemoExists
+	}
+	return s.Put(memo)
+}
+
+func (s *fileStore) Put(memo Memo) error {
+	err := s.write(fileRecord{Op: "put", Memo: memo})
+	if err != nil {
+		return err
+	}
+	return s.memoryStore.Put(memo)
+}
+
+func (s *fileStore) Patch(id int, patch MemoPatch) (Memo, bool, error) {
+	i, ok := s.find(id)
+	if !ok {
+		return Memo{}, false, nil
+	}
+	memo := patch.apply(s.memos[i])
+	err := s.Put(memo)
+	return memo, err == nil, err
+}
+
+func (s *fileStore) Delete(id int) (bool, error) {
+	if _, ok := s.find(id); !ok {
+		return false, nil
+	}
+	err := s.write(fileRecord{Op: "delete", Memo: Memo{ID: id}})
+	if err != nil {
+		return false, err
+	}
+	return s.memoryStore.Delete(id)
+}
+
+// rewrite replaces the file with one put record per memo
+func (s *fileStore) rewrite(memos []Memo) error {
+	var data []byte
+	for _, memo := range memos {
+		line, err := json.Marshal(fileRecord{Op: "put", Memo: memo})
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	// the path names the new file from here on, keep writing to it even if the rename may not be durable yet
+	s.file.Close()
+	s.file = f
+	return syncDir(filepath.Dir(s.path))
+}
+
+func (s *fileStore) Snapshot() ([]Memo, error) {
+	err := s.rewrite(s.memos)
+	if err != nil {
+		return nil, err
+	}
+	return s.List()
+}
+
+func (s *fileStore) Restore(memos []Memo) error {
+	s.memoryStore.Restore(memos)
+	return s.rewrite(s.memos)
+}
+
+func (s *fileStore) Close() error {
+	return s.file.Close()
+}
+
+// kvHeader is the size of a record header: checksum, tombstone flag, key length and value length
+const kvHeader = 13
+
+// kvPointer locates the latest value of a key in the data file
+type kvPointer struct {
+	offset int64 // of the record
+	size   int   // of the whole record
+}
+
+// kvDB is an embedded key-value store with one append-only data file and an index of every live key
+type kvDB struct {
+	path  string
+	file  *os.File
+	size  int64
+	index map[string]kvPointer
+	dead  int64 // bytes taken by overwritten and deleted records
+}
+
+func kvRecord(key string, value []byte, deleted bool) []byte {
+	rec := make([]byte, kvHeader+len(key)+len(value))
+	if deleted {
+		rec[4] = 1
+	}
+	binary.BigEndian.PutUint32(rec[5:], uint32(len(key)))
+	binary.BigEndian.PutUint32(rec[9:], uint32(len(value)))
+	copy(rec[kvHeader:], key)
+	copy(rec[kvHeader+len(key):], value)
+	binary.BigEndian.PutUint32(rec[0:], crc32.ChecksumIEEE(rec[4:]))
+	return rec
+}
+
+func openKV(path string) (*kvDB, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	db := &kvDB{path: path, index: make(map[string]kvPointer)}
+	offset := 0
+	for len(data)-offset >= kvHeader {
+		keyLen := int(binary.BigEndian.Uint32(data[offset+5:]))
+		valueLen := int(binary.BigEndian.Uint32(data[offset+9:]))
+		size := kvHeader + keyLen + valueLen
+		if size > len(data)-offset || crc32.ChecksumIEEE(data[offset+4:offset+size]) != binary.BigEndian.Uint32(data[offset:]) {
+			break
+		}
+		key := string(data[offset+kvHeader : offset+kvHeader+keyLen])
+		if old, ok := db.index[key]; ok {
+			db.dead += int64(old.size)
+		}
+		if data[offset+4] == 1 {
+			delete(db.index, key)
+			db.dead += int64(size)
+		} else {
+			db.index[key] = kvPointer{offset: int64(offset), size: size}
+		}
+		offset += size
+	}
+
+	db.file, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err == nil && offset < len(data) {
+		// cut off the torn record so that new records follow the last complete one
+		err = db.file.Truncate(int64(offset))
+	}
+	if err != nil {
+		return nil, err
+	}
+	db.size = int64(offset)
+	return db, nil
+}
+
+func (db *kvDB) Get(key string) ([]byte, bool, error) {
+	ptr, ok := db.index[key]
+	if !ok {
+		return nil, false, nil
+	}
+	rec := make([]byte, ptr.size)
+	_, err := db.file.ReadAt(rec, ptr.offset)
+	if err != nil {
+		return nil, false, err
+	}
+	if crc32.ChecksumIEEE(rec[4:]) != binary.BigEndian.Uint32(rec) {
+		return nil, false, fmt.Errorf("record of key %s at offset %d is damaged", key, ptr.offset)
+	}
+	return rec[kvHeader+len(key):], true, nil
+}
+
+func (db *kvDB) append(key string, value []byte, deleted bool) (kvPointer, error) {
+	rec := kvRecord(key, value, deleted)
+	_, err := db.file.Write(rec)
+	if err == nil {
+		err = db.file.Sync()
+	}
+	if err != nil {
+		return kvPointer{}, err
+	}
+	ptr := kvPointer{offset: db.size, size: len(rec)}
+	db.size += int64(len(rec))
+	return ptr, nil
+}
+
+func (db *kvDB) Set(key string, value []byte) error {
+	ptr, err := db.append(key, value, false)
+	if err != nil {
+		return err
+	}
+	if old, ok := db.index[key]; ok {
+		db.dead += int64(old.size)
+	}
+	db.index[key] = ptr
+	return nil
+}
+
+func (db *kvDB) Delete(key string) (bool, error) {
+	old, ok := db.index[key]
+	if !ok {
+		return false, nil
+	}
+	ptr, err := db.append(key, nil, true)
+	if err != nil {
+		return false, err
+	}
+	delete(db.index, key)
+	db.dead += int64(old.size + ptr.size)
+	return true, nil
+}
+
+// Keys returns every live key in order
+func (db *kvDB) Keys() []string {
+	keys := make([]string, 0, len(db.index))
+	for key := range db.index {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Rewrite replaces the data file with one holding exactly the given keys and values
+func (db *kvDB) Rewrite(keys []string, values [][]byte) error {
+	tmp := db.path + ".merge"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	index := make(map[string]kvPointer, len(keys))
+	var size int64
+	for i, key := range keys {
+		rec := kvRecord(key, values[i], false)
+		_, err = f.Write(rec)
+		if err != nil {
+			break
+		}
+		index[key] = kvPointer{offset: size, size: len(rec)}
+		size += int64(len(rec))
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, db.path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	// db.path is the merged file now, switch to it before reporting a failed directory sync
+	db.file.Close()
+	db.file, db.size, db.index, db.dead = f, size, index, 0
+	return syncDir(filepath.Dir(db.path))
+}
+
+// Merge drops the overwritten and deleted records from the data file
+func (db *kvDB) Merge() error {
+	keys := db.Keys()
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		value, _, err := db.Get(key)
+		if err != nil {
+			return err
+		}
+		values[i] = value
+	}
+	return db.Rewrite(keys, values)
+}
+
+func (db *kvDB) Close() error {
+	return db.file.Close()
+}
+
+// kvStore is the "kv" backend, a memo is stored as JSON under its zero-padded ID so that keys sort by ID
+type kvStore struct {
+	db *kvDB
+}
+
+func openKVStore(path string) (*kvStore, error) {
+	db, err := openKV(path)
+	if err != nil {
+		return nil, err
+	}
+	return &kvStore{db: db}, nil
+}
+
+func kvKey(id int) string {
+	return fmt.Sprintf("%020d", id)
+}
+
+func (s *kvStore) Get(id int) (Memo, bool, error) {
+	var memo Memo
+	value, ok, err := s.db.Get(kvKey(id))
+	if err != nil || !ok {
+		return memo, false, err
+	}
+	err = json.Unmarshal(value, &memo)
+	return memo, err == nil, err
+}
+
+func (s *kvStore) List() ([]Memo, error) {
+	memos := []Memo{}
+	for _, key := range s.db.Keys() {
+		value, _, err := s.db.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		var memo Memo
+		err = json.Unmarshal(value, &memo)
+		if err != nil {
+			return nil, err
+		}
+		memos = append(memos, memo)
+	}
+	return memos, nil
+}
+
+func (s *kvStore) Create(memo Memo) error {
+	if _, ok := s.db.index[kvKey(memo.ID)]; ok {
+		return errMemoExists
+	}
+	return s.Put(memo)
+}
+
+func (s *kvStore) Put(memo Memo) error {
+	value, err := json.Marshal(memo)
+	if err != nil {
+		return err
+	}
+	return s.db.Set(kvKey(memo.ID), value)
+}
+
+func (s *kvStore) Patch(id int, patch MemoPatch) (Memo, bool, error) {
+	memo, ok, err := s.Get(id)
+	if err != nil || !ok {
+		return memo, false, err
+	}
+	memo = patch.apply(memo)
+	err = s.Put(memo)
+	return memo, err == nil, err
+}
+
+func (s *kvStore) Delete(id int) (bool, error) {
+	return s.db.Delete(kvKey(id))
+}
+
+func (s *kvStore) Snapshot() ([]Memo, error) {
+	err := s.db.Merge()
+	if err != nil {
+		return nil, err
+	}
+	return s.List()
+}
+
+func (s *kvStore) Restore(memos []Memo) error {
+	keys := make([]string, len(memos))
+	values := make([][]byte, len(memos))
+	sorted := append([]Memo{}, memos...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+	for i, memo := range sorted {
+		value, err := json.Marshal(memo)
+		if err != nil {
+			return err
+		}
+		keys[i], values[i] = kvKey(memo.ID), value
+	}
+	return s.db.Rewrite(keys, values)
+}
+
+func (s *kvStore) Close() error {
+	return s.db.Close()
+}
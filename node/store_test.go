@@ -0,0 +1,167 @@
+package node
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestStoreConformance runs the same checks against every backend, the durable ones are also reopened, once
+// as they were left and once with a torn record at the end of their file
+func TestStoreConformance(t *testing.T) {
+	for _, kind := range []string{"memory", "file", "kv"} {
+		t.Run(kind, func(t *testing.T) {
+			if err := storeConformance(kind, t.TempDir()); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func storeConformance(kind string, dir string) error {
+	s, err := openStore(kind, dir)
+	if err != nil {
+		return err
+	}
+	defer func() { s.Close() }()
+
+	expect := func(step string, want []Memo) error {
+		got, err := s.List()
+		if err != nil {
+			return fmt.Errorf("%s: %s", step, err)
+		}
+		if len(got) != len(want) || (len(want) > 0 && !reflect.DeepEqual(got, want)) {
+			return fmt.Errorf("%s: listed %+v, expected %+v", step, got, want)
+		}
+		return nil
+	}
+
+	if err := expect("empty store", nil); err != nil {
+		return err
+	}
+	one := Memo{ID: 1, Title: "one", Body: "first", Version: 1}
+	two := Memo{ID: 2, Title: "two", Body: "second", Version: 1}
+	three := Memo{ID: 3, Title: "three", Body: "third", Version: 4, VersionNode: "127.0.0.1:8081"}
+	for _, memo := range []Memo{three, one, two} {
+		if err := s.Create(memo); err != nil {
+			return fmt.Errorf("create %d: %s", memo.ID, err)
+		}
+	}
+	if err := expect("list after create", []Memo{one, two, three}); err != nil {
+		return err
+	}
+	if err := s.Create(Memo{ID: 2, Title: "again"}); err != errMemoExists {
+		return fmt.Errorf("create of a taken ID returned %v", err)
+	}
+	if memo, ok, err := s.Get(3); err != nil || !ok || !sameMemo(memo, three) {
+		return fmt.Errorf("get 3 returned %+v %v %v", memo, ok, err)
+	}
+	if _, ok, err := s.Get(9); err != nil || ok {
+		return fmt.Errorf("get of a missing memo returned %v %v", ok, err)
+	}
+
+	two = Memo{ID: 2, Title: "two", Body: "replaced", Version: 2}
+	five := Memo{ID: 5, Title: "five", Body: "put", Version: 1}
+	if err := s.Put(two); err != nil {
+		return fmt.Errorf("put 2: %s", err)
+	}
+	if err := s.Put(five); err != nil {
+		return fmt.Errorf("put 5: %s", err)
+	}
+	if err := expect("list after put", []Memo{one, two, three, five}); err != nil {
+		return err
+	}
+
+	title := "ONE"
+	one.Title, one.Version = title, 2
+	if memo, ok, err := s.Patch(1, MemoPatch{Title: &title}); err != nil || !ok || !sameMemo(memo, one) {
+		return fmt.Errorf("patch of the title returned %+v %v %v", memo, ok, err)
+	}
+	body := "patched"
+	three.Body, three.Version = body, 9
+	if memo, ok, err := s.Patch(3, MemoPatch{Body: &body, Version: 9}); err != nil || !ok || !sameMemo(memo, three) {
+		return fmt.Errorf("patch with a version returned %+v %v %v", memo, ok, err)
+	}
+	if _, ok, err := s.Patch(9, MemoPatch{Title: &title}); err != nil || ok {
+		return fmt.Errorf("patch of a missing memo returned %v %v", ok, err)
+	}
+
+	if ok, err := s.Delete(2); err != nil || !ok {
+		return fmt.Errorf("delete 2 returned %v %v", ok, err)
+	}
+	if ok, err := s.Delete(2); err != nil || ok {
+		return fmt.Errorf("second delete of 2 returned %v %v", ok, err)
+	}
+	if err := expect("list after delete", []Memo{one, three, five}); err != nil {
+		return err
+	}
+
+	snapshot, err := s.Snapshot()
+	if err != nil || !reflect.DeepEqual(snapshot, []Memo{one, three, five}) {
+		return fmt.Errorf("snapshot returned %+v %v", snapshot, err)
+	}
+	snapshot[0].Title = "changed"
+	if err := expect("list after changing the snapshot", []Memo{one, three, five}); err != nil {
+		return err
+	}
+	if err := s.Put(two); err != nil {
+		return fmt.Errorf("put after snapshot: %s", err)
+	}
+	if err := expect("list after put behind the snapshot", []Memo{one, two, three, five}); err != nil {
+		return err
+	}
+
+	restored := []Memo{five, {ID: 7, Title: "seven", Body: "restored", Version: 3}, two}
+	if err := s.Restore(restored); err != nil {
+		return fmt.Errorf("restore: %s", err)
+	}
+	want := []Memo{two, five, restored[1]}
+	if err := expect("list after restore", want); err != nil {
+		return err
+	}
+	if err := s.Put(one); err != nil {
+		return fmt.Errorf("put after restore: %s", err)
+	}
+	want = []Memo{one, two, five, restored[1]}
+	if kind == "memory" {
+		return expect("list after put behind the restore", want)
+	}
+
+	s.Close()
+	s, err = openStore(kind, dir)
+	if err != nil {
+		return fmt.Errorf("reopen: %s", err)
+	}
+	if err := expect("list after reopening", want); err != nil {
+		return err
+	}
+
+	ext := map[string]string{"file": ".log", "kv": ".kv"}[kind]
+	path := filepath.Join(dir, "memos-"+strings.Replace(SelfAddr, ":", "_", -1)+ext)
+	s.Close()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	f.Write([]byte("\x00\x00\x00\x07{\"torn"))
+	f.Close()
+	s, err = openStore(kind, dir)
+	if err != nil {
+		return fmt.Errorf("reopen after a torn record: %s", err)
+	}
+	if err := expect("list after a torn record", want); err != nil {
+		return err
+	}
+	if ok, err := s.Delete(1); err != nil || !ok {
+		return fmt.Errorf("delete after a torn record returned %v %v", ok, err)
+	}
+	s.Close()
+	s, err = openStore(kind, dir)
+	if err != nil {
+		return fmt.Errorf("reopen after writing past a torn record: %s", err)
+	}
+	return expect("list after writing past a torn record", want[1:])
+}
@@ -0,0 +1,299 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Write-ahead log ("walDir": "wal")
+
+	Every entry of the replication log is appended to the current log segment in walDir before the write is
+	acknowledged, one JSON record per line. A segment is named after the first sequence number it holds,
+	wal-<node>-<seq>.log, and a new one is started with every snapshot. "walSync" decides when the segment is
+	fsynced: "always" after every record (the default), "batched" once every walSyncIntervalMs, which loses
+	at most that much of the acknowledged writes when the machine goes down, and "none" leaves it to the
+	operating system. On startup the node loads its latest valid snapshot and replays the newer entries, a
+	torn record at the end of the last segment is cut off. Local-write, quorum, multi-primary and raft nodes
+	keep no replication log and therefore no write-ahead log, they refuse a walDir at startup. A write they
+	acknowledge is only as durable as the store ("file" or "kv", raft runs on "memory" only), and a node
+	that restarts on the memory store has lost it unless a peer still holds a copy.
+*/
+
+// snapshotState is what /replication/snapshot serves and what a snapshot file holds
+type snapshotState struct {
+	Seq     uint64                      `json:"seq"`
+	IDCount int                         `json:"idCount"`
+	Memos   []Memo                      `json:"memos"`
+	Docs    map[int]*crdtOps            `json:"docs"`
+	Keys    map[string]idempotentResult `json:"keys"`
+}
+
+var (
+	walMu      sync.Mutex
+	walFile    *os.File // current segment, nil while the log is off or still being replayed
+	walSegment uint64   // first sequence number of the current segment
+	walDirty   bool     // records written since the last fsync, batched policy only
+)
+
+func walEnabled() bool {
+	return Config.WALDir != "" && keepsLog()
+}
+
+// keepsLog tells whether the mode keeps the replication log the write-ahead log is made of
+func keepsLog() bool {
+	return Config.Sync != "local-write" && Config.Sync != "quorum" && Config.Sync != "multi-primary" && Config.Sync != "raft"
+}
+
+func walSyncPolicy() string {
+	if Config.WALSync == "" {
+		return "always"
+	}
+	return Config.WALSync
+}
+
+func walSyncInterval() time.Duration {
+	if Config.WALSyncIntervalMs <= 0 {
+		return 100 * time.Millisecond
+	}
+	return time.Duration(Config.WALSyncIntervalMs) * time.Millisecond
+}
+
+// walName is the path of this node's segment ("wal", ".log") or snapshot ("snap", ".json") for a sequence number
+func walName(kind string, seq uint64, ext string) string {
+	return filepath.Join(Config.WALDir, fmt.Sprintf("%s-%s-%020d%s", kind, strings.Replace(SelfAddr, ":", "_", -1), seq, ext))
+}
+
+func segmentPath(first uint64) string {
+	return walName("wal", first, ".log")
+}
+
+func snapshotPath(seq uint64) string {
+	return walName("snap", seq, ".json")
+}
+
+// walFiles returns the sequence numbers of this node's segments or snapshots, oldest first
+func walFiles(kind string, ext string) []uint64 {
+	prefix := kind + "-" + strings.Replace(SelfAddr, ":", "_", -1) + "-"
+	names, _ := filepath.Glob(filepath.Join(Config.WALDir, prefix+"*"+ext))
+
+	var seqs []uint64
+	for _, name := range names {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(name), prefix), ext), 10, 64)
+		if err == nil {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs
+}
+
+// syncDir makes renames and newly created files in the directory durable
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// walWrite appends one entry to the current segment and syncs it as the policy says
+func walWrite(entry LogEntry) error {
+	walMu.Lock()
+	defer walMu.Unlock()
+
+	if walFile == nil {
+		return nil
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = walFile.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	switch walSyncPolicy() {
+	case "always":
+		return walFile.Sync()
+	case "batched":
+		walDirty = true
+	}
+	return nil
+}
+
+// walAppend makes the entry durable before the write is acknowledged, it must be called with memosMu held
+func walAppend(entry LogEntry) {
+	err := walWrite(entry)
+	if err != nil {
+		// the change is already applied in memory, a node that cannot make it durable must not acknowledge it
+		log.Fatalf("Failed to write the write-ahead log: %s\n", err)
+	}
+}
+
+// walRotate starts an empty segment for the entries from next on, it must be called with memosMu held
+func walRotate(next uint64) error {
+	walMu.Lock()
+	defer walMu.Unlock()
+
+	if walFile == nil {
+		return nil
+	}
+	err := walFile.Sync()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(segmentPath(next), os.O_CREATE|os.O_TRUNC|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	walFile.Close()
+	walFile, walSegment, walDirty = f, next, false
+	return syncDir(Config.WALDir)
+}
+
+// runWALSync fsyncs the records written since the last round, batched policy only
+func runWALSync() {
+	for {
+		time.Sleep(walSyncInterval())
+
+		walMu.Lock()
+		if walDirty {
+			err := walFile.Sync()
+			if err != nil {
+				log.Fatalf("Failed to sync the write-ahead log: %s\n", err)
+			}
+			walDirty = false
+		}
+		walMu.Unlock()
+	}
+}
+
+// currentSnapshot must be called with memosMu held, memos are the ones the store holds
+func currentSnapshot(memos []Memo) snapshotState {
+	return snapshotState{
+		Seq:     LastSeq,
+		IDCount: IDCount,
+		Memos:   memos,
+		Docs:    crdtSnapshot(),
+		Keys:    idempotencyKeys,
+	}
+}
+
+// restoreSnapshot replaces every memo and the replication log with the snapshot, it must be called with
+// memosMu held
+func restoreSnapshot(snapshot snapshotState) {
+	err := MemoStore.Restore(snapshot.Memos)
+	if err != nil {
+		storeFailed(err)
+	}
+	IDCount = snapshot.IDCount
+	if snapshot.Keys != nil {
+		idempotencyKeys = snapshot.Keys
+	}
+	crdtDocs = make(map[int]*textDoc)
+	for id, state := range snapshot.Docs {
+		crdtApply(id, state)
+	}
+	LastSeq = snapshot.Seq
+	ReplLog = nil
+	LogStart = snapshot.Seq + 1
+}
+
+// replaySegment applies the entries of one segment that come after lastSeq and returns how many it applied
+// and how many bytes at the end could not be read, it must be called with memosMu held
+func replaySegment(first uint64) (int, int, error) {
+	data, err := ioutil.ReadFile(segmentPath(first))
+	if err != nil {
+		return 0, 0, err
+	}
+	if first > LastSeq+1 {
+		return 0, 0, fmt.Errorf("%s starts at seq %d but the node is at seq %d", segmentPath(first), first, LastSeq)
+	}
+
+	replayed, offset := 0, 0
+	for offset < len(data) {
+		end := bytes.IndexByte(data[offset:], '\n')
+		var entry LogEntry
+		if end < 0 || json.Unmarshal(data[offset:offset+end], &entry) != nil {
+			break
+		}
+		if entry.Seq > LastSeq+1 {
+			return replayed, 0, fmt.Errorf("%s jumps from seq %d to %d", segmentPath(first), LastSeq, entry.Seq)
+		}
+		if entry.Seq == LastSeq+1 {
+			ApplyEntry(entry)
+			recordApplied(entry)
+			replayed++
+		}
+		offset += end + 1
+	}
+	return replayed, len(data) - offset, nil
+}
+
+// replayWAL rebuilds the memos and the replication log from the latest snapshot and the newer log segments,
+// and opens the last segment for appending
+func replayWAL() {
+	if !walEnabled() {
+		return
+	}
+	started := time.Now()
+	err := os.MkdirAll(Config.WALDir, 0755)
+	if err != nil {
+		log.Fatalf("Failed to create the WAL directory: %s\n", err)
+	}
+
+	MemosMu.Lock()
+	defer MemosMu.Unlock()
+
+	loadSnapshot()
+	segments := walFiles("wal", ".log")
+	replayed, torn := 0, 0
+	for i, first := range segments {
+		n, cut, err := replaySegment(first)
+		if err != nil {
+			log.Fatalf("The write-ahead log cannot be replayed: %s\n", err)
+		}
+		if cut > 0 && i < len(segments)-1 {
+			log.Fatalf("The write-ahead log cannot be replayed: %s has %d unreadable bytes\n", segmentPath(first), cut)
+		}
+		replayed += n
+		torn = cut
+	}
+
+	// the last segment goes on where replay stopped, without segments a new one starts after the snapshot
+	walSegment = LastSeq + 1
+	if len(segments) > 0 {
+		walSegment = segments[len(segments)-1]
+	}
+	f, err := os.OpenFile(segmentPath(walSegment), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err == nil && torn > 0 {
+		// new records have to follow the last complete one
+		var info os.FileInfo
+		info, err = f.Stat()
+		if err == nil {
+			err = f.Truncate(info.Size() - int64(torn))
+		}
+		fmt.Printf("[2023 %s] %s SERVER [WAL]            Cut off %d bytes of a torn record\n", time.Now().Format(time.StampNano), Role, torn)
+	}
+	if err != nil {
+		log.Fatalf("Failed to open the write-ahead log: %s\n", err)
+	}
+	walMu.Lock()
+	walFile = f
+	walMu.Unlock()
+
+	walStartup = walReplay{Snapshot: lastSnapshot.Seq, SnapshotBytes: lastSnapshot.Bytes, Replayed: replayed, DurationMs: msSince(started)}
+	fmt.Printf("[2023 %s] %s SERVER [WAL]            Loaded snapshot at seq %d and replayed %d entries, %d memos at seq %d in %.1fms (fsync %s)\n", time.Now().Format(time.StampNano), Role, lastSnapshot.Seq, replayed, len(AllMemos()), LastSeq, walStartup.DurationMs, walSyncPolicy())
+}
@@ -1,3 +1,5 @@
+//go:build ignore
+
 /*
 	2023.12.01 ~ 2023.12.12
 	Jongki Park
@@ -12,38 +14,15 @@ import (
 	"log"
 	"net/http"
 	"strconv"
-	"bytes"
-	"sync"
 	"time"
 	"io/ioutil"
 	"os"
+	"strings"
 	"path/filepath"
 	"github.com/gorilla/mux"
+	"Simple_DistributedSystem/node"
 )
 
-type Configuration struct {
-	ServicePort int		`json:"servicePort"`
-	Sync		string	`json:"sync"`
-	Replicas	[]string`json:"replicas"`
-}
-
-type Memo struct {
-	ID    int    `json:"id"`
-	Title string `json:"title"`
-	Body  string `json:"body"`
-}
-
-var (
-	memos   []Memo
-	memosMu sync.Mutex
-	idCount = 0
-)
-
-func logRequest(r *http.Request, args ...interface{}) {
-    message := fmt.Sprint(args...)
-    fmt.Printf("[2023 %s] Primary SERVER [REQUEST]        [METHOD: %s] %s\n", time.Now().Format(time.StampNano), r.Method, message)
-}
-
 func getReplicaURLByIndex(index int) (string, error) {
 	configFile := os.Args[1]
 
@@ -52,7 +31,7 @@ func getReplicaURLByIndex(index int) (string, error) {
         return "", err
     }
 
-    var config Configuration
+    var config node.Configuration
     err = json.Unmarshal(configData, &config)
     if err != nil {
         return "", err
@@ -67,180 +46,105 @@ func getReplicaURLByIndex(index int) (string, error) {
     return replicaURL, nil
 }
 
-func syncReplica(r *http.Request, url string, newMemo Memo) (*http.Response, error) {
-    if r.Method == http.MethodPost {
-		fmt.Printf("[2023 %s] Primary SERVER [UPDATE REPLICA] [METHOD: %s] Request to [%s]\n", time.Now().Format(time.StampNano), r.Method, url)
-
-        postData, err := json.Marshal(map[string]interface{}{
-            "title": newMemo.Title,
-            "body":  newMemo.Body,
-        })
-        if err != nil {
-            return nil, err
-        }
-
-		reqPost, err := http.NewRequest("POST", url, bytes.NewBuffer(postData))
-		if err != nil {
-			fmt.Println("POST request error:", err)
-			return nil, err
-		}
-
-		reqPost.Header.Set("From-Primary", "true")
-		reqPost.Header.Set("Content-Type", "application/json")
-		reqPost.Header.Set("Cache-Control", "no-cache")
-		resp, err := http.DefaultClient.Do(reqPost)
-		if err != nil {
-			fmt.Println("POST request error", err)
-			return nil, err
-		}
-		defer resp.Body.Close()
-
-		fmt.Printf("[2023 %s] Primary SERVER [ACK UPDATE]     [METHOD: %s] Reply from [%s]\n", time.Now().Format(time.StampNano), r.Method, url)
-
-		//body, err := ioutil.ReadAll(resp.Body)
-		//fmt.Println("Sync Response from Replica Server POST Response Status:", resp.Status)
-		//fmt.Println("Sync Response from Replica Server POST Response Body:", string(body))
-		return resp, nil
-
-	} else if r.Method == http.MethodDelete {
-		deleteURL := fmt.Sprintf("%s/%d", url, newMemo.ID)
-		fmt.Printf("[2023 %s] Primary SERVER [UPDATE REPLICA] [METHOD: %s] Request to [%s]\n", time.Now().Format(time.StampNano), r.Method, deleteURL)
-
-		reqDelete, err := http.NewRequest("DELETE", deleteURL, nil)
-		if err != nil {
-			fmt.Printf("DELETE request error:", err)
-			return nil, err
-		}
-
-		reqDelete.Header.Set("From-Primary", "true")
-		resp, err := http.DefaultClient.Do(reqDelete)
-		if err != nil {
-			fmt.Printf("DELETE request error:", err)
-			return nil, err
-		}
-		defer resp.Body.Close()
-
-		fmt.Printf("[2023 %s] Primary SERVER [ACK UPDATE]     [METHOD: %s] Reply from [%s]\n", time.Now().Format(time.StampNano), r.Method, url)
-
-		//body, err := ioutil.ReadAll(resp.Body)
-		//fmt.Println("DELETE Response Status:", resp.Status)
-		//fmt.Println("DELETE Response Body:", string(body))
-		return resp, err
-
-	} else if r.Method == http.MethodPatch {
-		patchURL := fmt.Sprintf("%s/%d", url, newMemo.ID)
-		fmt.Printf("[2023 %s] Primary SERVER [UPDATE REPLICA] [METHOD: %s] Request to [%s]\n", time.Now().Format(time.StampNano), r.Method, patchURL)
-
-		patchData := make(map[string]interface{})
-
-		// Update the patchData based on newMemo fields
-		if newMemo.Title != "" {
-			patchData["title"] = newMemo.Title
-		}
-		if newMemo.Body != "" {
-			patchData["body"] = newMemo.Body
-		}
-
-		// Marshal patchData to JSON
-		jsonData, err := json.Marshal(patchData)
-		if err != nil {
-			fmt.Println("Error marshaling patchData:", err)
-			return nil, err
-		}
-
-		reqPatch, err := http.NewRequest("PATCH", patchURL, bytes.NewBuffer(jsonData))
-		if err != nil {
-			fmt.Printf("PATCH request error:", err)
-			return nil, err
-		}
-
-		reqPatch.Header.Set("From-Primary", "true")
-		reqPatch.Header.Set("Content-Type", "application/json")
-		resp, err := http.DefaultClient.Do(reqPatch)
-		if err != nil {
-			fmt.Println("PATCH request error:", err)
-			return nil, err
-		}
-		defer resp.Body.Close()
-
-		fmt.Printf("[2023 %s] Primary SERVER [ACK REPLICA]    [METHOD: %s] Reply from [%s]\n", time.Now().Format(time.StampNano), r.Method, url)
-
-		//body, err := ioutil.ReadAll(resp.Body)
-		//fmt.Println("PATCH Response Status:", resp.Status)
-		//fmt.Println("PATCH Response Body:", string(body))
-		return resp, err
+// forwardToPrimary proxies a client request to the current primary as it is
+func forwardToPrimary(w http.ResponseWriter, r *http.Request) {
+	primaryURL, err := node.GetPrimaryURL()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 
-	} else if r.Method == http.MethodPut {
-		putURL := fmt.Sprintf("%s/%d", url, newMemo.ID)
-		fmt.Printf("[2023 %s] Primary SERVER [UPDATE REPLICA] [METHOD: %s] Request to [%s]\n", time.Now().Format(time.StampNano), r.Method, putURL)
+	url := strings.TrimSuffix(primaryURL, "/note") + r.URL.Path
+	fmt.Printf("[2023 %s] Primary SERVER [FORWARD]        [METHOD: %s] to [%s]\n", time.Now().Format(time.StampNano), r.Method, url)
 
-		putData := make(map[string]interface{})
+	node.ProxyRequest(w, r, url)
+}
 
-		// Update the putData based on newMemo fields
-		if newMemo.Title != "" {
-			putData["title"] = newMemo.Title
-		}
-		if newMemo.Body != "" {
-			putData["body"] = newMemo.Body
-		}
+func addMemo(w http.ResponseWriter, r *http.Request) {
+	if !node.ConsistencyLevel(w, r) {
+		return
+	}
+	if node.Config.Sync == "quorum" {
+		node.QuorumRequest(w, r)
+		return
+	}
+	if node.Config.Sync == "multi-primary" {
+		node.MultiRequest(w, r)
+		return
+	}
 
-		// Marshal putData to JSON
-		jsonData, err := json.Marshal(putData)
-		if err != nil {
-			fmt.Println("Error marshaling putData:", err)
-			return nil, err
-		}
+	if node.Config.Sync == "local-write" && r.Method != http.MethodGet {
+		node.LocalWrite(w, r)
+		return
+	}
+	if node.Config.Sync == "raft" && r.Method != http.MethodGet {
+		node.RaftWrite(w, r)
+		return
+	}
+	if node.Config.Sync == "chain" && r.Method == http.MethodGet && node.ChainRead(w, r) {
+		return
+	}
 
-		reqPut, err := http.NewRequest("PUT", putURL, bytes.NewBuffer(jsonData))
-		if err != nil {
-			fmt.Printf("PUT request error:", err)
-			return nil, err
+	// after stepping down this node serves reads and applies updates like a replica
+	if r.Header.Get("From-Primary") == "true" {
+		if r.Method == http.MethodGet {
+			if node.RefuseIfNotReady(w, r) {
+				return
+			}
+		} else {
+			node.LogRequest(r, "Received Update Request from Primary server")
+			node.ApplyFromPrimary(w, r)
+			return
 		}
-
-		reqPut.Header.Set("From-Primary", "true")
-		reqPut.Header.Set("Content-Type", "application/json")
-		resp, err := http.DefaultClient.Do(reqPut)
-		if err != nil {
-			fmt.Println("PUT request error:", err)
-			return nil, err
+	} else if !node.AmPrimary() {
+		if r.Method == http.MethodGet {
+			if node.RefuseIfNotReady(w, r) || node.AwaitToken(w, r) || node.BoundedRead(w, r) {
+				return
+			}
+		} else {
+			forwardToPrimary(w, r)
+			return
 		}
-		defer resp.Body.Close()
-
-		fmt.Printf("[2023 %s] Primary SERVER [ACK UPDATE]     [METHOD: %s] Reply from [%s]\n", time.Now().Format(time.StampNano), r.Method, url)
-
-		//body, err := ioutil.ReadAll(resp.Body)
-		//fmt.Println("PUT Response Status:", resp.Status)
-		//fmt.Println("PUT Response Body:", string(body))
-		return resp, err
-
-	} else {
-		fmt.Printf("Not ready to handle other methods\n")
-		return nil, fmt.Errorf("unsupported method: %s", r.Method)
 	}
-}
-
-func addMemo(w http.ResponseWriter, r *http.Request) {
-	replicaURL1, err := getReplicaURLByIndex(1)
-	if err != nil {
+	if node.RequireLease(w, r) {
+		return
+	}
+	done, answered := node.IdempotencyGuard(w, r)
+	if answered {
+		return
+	}
+	defer done()
+	if node.Config.Sync == "atomic" && r.Method != http.MethodGet {
+		node.AtomicWrite(w, r)
+		return
+	}
+	if r.Method == http.MethodGet && node.ConsistentRead(w, r) {
 		return
 	}
 
 	if r.Method == http.MethodPost {
-		var newMemo Memo
+		var newMemo node.Memo
 		err := json.NewDecoder(r.Body).Decode(&newMemo)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		memosMu.Lock()
-		defer memosMu.Unlock()
-
-		idCount++
-		newMemo.ID = idCount
-		memos = append(memos, newMemo)
+		node.MemosMu.Lock()
+		node.IDCount++
+		newMemo.ID = node.IDCount
+		newMemo.Version = 1
+		err = node.MemoStore.Create(newMemo)
+		if err != nil {
+			node.MemosMu.Unlock()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		entry := node.AppendLog(r, newMemo)
+		// the entry has its place in the log, other writes need not wait for the replicas to answer
+		node.MemosMu.Unlock()
 
-		logRequest(r, "Received new memo with title: ", newMemo.Title)
+		node.LogRequest(r, "Received new memo with title: ", newMemo.Title)
 
 		response, err := json.Marshal(newMemo)
 		if err != nil {
@@ -248,6 +152,15 @@ func addMemo(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		ok, results := node.ReplicateUpdate(r, entry)
+		if !ok {
+			node.ReplicationFailed(w, r, newMemo, results)
+			return
+		}
+		node.SetAckHeader(w, results)
+		node.SetConsistencyToken(w, entry.Seq)
+		node.SetETag(w, newMemo)
+
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
 		_, _ = w.Write(response)
@@ -255,16 +168,8 @@ func addMemo(w http.ResponseWriter, r *http.Request) {
 		message := string(response)
 		fmt.Printf("[2023 %s] Primary SERVER [REPLY]          [METHOD: %s] %s\n", time.Now().Format(time.StampNano), r.Method, message)
 
-		resp, err := syncReplica(r, replicaURL1, newMemo)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		defer resp.Body.Close()
-		// do something with the response
-
 	} else if r.Method == http.MethodGet {
-		logRequest(r, "Received GET request")
+		node.LogRequest(r, "Received GET request")
 		var message string
 
 		params := mux.Vars(r)
@@ -275,34 +180,39 @@ func addMemo(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			memosMu.Lock()
-			defer memosMu.Unlock()
-
-			found := false
-			for _, memo := range memos {
-				if memo.ID == id {
-					response, err := json.Marshal(memo)
-					if err != nil {
-						http.Error(w, err.Error(), http.StatusInternalServerError)
-						return
-					}
-
-					w.Header().Set("Content-Type", "application/json")
-					w.WriteHeader(http.StatusOK)
-					_, _ = w.Write(response)
-
-					message = string(response)
-					found = true
-					break
-				}
+			node.MemosMu.Lock()
+			defer node.MemosMu.Unlock()
+
+			memo, found, err := node.MemoStore.Get(id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
 			}
-			if !found {
+			if found {
+				response, err := json.Marshal(memo)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				node.SetETag(w, memo)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusOK)
+				_, _ = w.Write(response)
+
+				message = string(response)
+			} else {
 				message = "No Data"
 			}
 		} else {
-			memosMu.Lock()
-			defer memosMu.Unlock()
+			node.MemosMu.Lock()
+			defer node.MemosMu.Unlock()
 
+			memos, err := node.MemoStore.List()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
 			if len(memos) == 0 {
 				message = "No Data"
 			} else {
@@ -322,7 +232,7 @@ func addMemo(w http.ResponseWriter, r *http.Request) {
 		fmt.Printf("[2023 %s] Primary SERVER [REPLY]          [METHOD: %s] %s\n", time.Now().Format(time.StampNano), r.Method, message)
 
 	} else if r.Method == http.MethodDelete {
-		logRequest(r, "Received DELETE request")
+		node.LogRequest(r, "Received DELETE request")
 
 		params := mux.Vars(r)
 		if idStr, ok := params["id"]; ok {
@@ -332,28 +242,48 @@ func addMemo(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			var newMemo Memo
+			var newMemo node.Memo
 			newMemo.ID = id
 
-			memosMu.Lock()
-			defer memosMu.Unlock()
-
-			for i, memo := range memos {
-				if memo.ID == id {
-					memos = append(memos[:i], memos[i+1:]...)
-					w.Header().Set("Content-Type", "application/json")
-					w.WriteHeader(http.StatusOK)
-					_, _ = w.Write([]byte(`{"msg": "OK"}`))
-					fmt.Printf("[2023 %s] Primary SERVER [REPLY]          [METHOD: %s] %s\n", time.Now().Format(time.StampNano), r.Method, `{"msg": "OK"}`)
-
-					_, err := syncReplica(r, replicaURL1, newMemo)
-					if err != nil {
-						log.Printf("Failed to sync DELETE request to %s\n", replicaURL1)
-					}
+			node.MemosMu.Lock()
+			memo, found, err := node.MemoStore.Get(id)
+			if err != nil {
+				node.MemosMu.Unlock()
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if found {
+				if !node.IfMatch(r, memo) {
+					node.MemosMu.Unlock()
+					node.PreconditionFailed(w, r, memo)
+					return
+				}
+				newMemo.Version = memo.Version
+				_, err = node.MemoStore.Delete(id)
+				if err != nil {
+					node.MemosMu.Unlock()
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				entry := node.AppendLog(r, newMemo)
+				node.MemosMu.Unlock()
+
+				ok, results := node.ReplicateUpdate(r, entry)
+				if !ok {
+					node.ReplicationFailed(w, r, newMemo, results)
 					return
 				}
+				node.SetAckHeader(w, results)
+				node.SetConsistencyToken(w, entry.Seq)
+
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusOK)
+				_, _ = w.Write([]byte(`{"msg": "OK"}`))
+				fmt.Printf("[2023 %s] Primary SERVER [REPLY]          [METHOD: %s] %s\n", time.Now().Format(time.StampNano), r.Method, `{"msg": "OK"}`)
+				return
 			}
 
+			node.MemosMu.Unlock()
 			http.Error(w, "Memo not found", http.StatusNotFound)
 			fmt.Printf("[2023 %s] Primary SERVER [UPATE REPLICA]  [METHOD: %s] No NEED TO UPDATE REPLICA\n", time.Now().Format(time.StampNano), r.Method)
 			return
@@ -361,7 +291,7 @@ func addMemo(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid endpoint", http.StatusBadRequest)
 
 	} else if r.Method == http.MethodPatch {
-		logRequest(r, "Received PATCH request")
+		node.LogRequest(r, "Received PATCH request")
 
 		params := mux.Vars(r)
 		if idStr, ok := params["id"]; ok {
@@ -378,47 +308,68 @@ func addMemo(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			var newMemo Memo
+			var newMemo node.Memo
 			newMemo.ID = id
-			newMemo.Title = ""
-			newMemo.Body = ""
-
-			memosMu.Lock()
-			defer memosMu.Unlock()
-
-			for i, memo := range memos {
-				if memo.ID == id {
-					// Update the memo with the new body if provided in the request
-					if newBody, ok := requestBody["body"]; ok {
-						memos[i].Body = newBody
-						newMemo.Body = newBody
-					}
-
-					if newTitle, ok := requestBody["title"]; ok {
-						memos[i].Title = newTitle
-						newMemo.Title = newTitle
-					}
-
-					response, err := json.Marshal(memos[i])
-					if err != nil {
-						http.Error(w, err.Error(), http.StatusInternalServerError)
-						return
-					}
-
-					w.Header().Set("Content-Type", "application/json")
-					w.WriteHeader(http.StatusOK)
-					_, _ = w.Write(response)
-
-					fmt.Printf("[2023 %s] Primary SERVER [REPLY]          [METHOD: %s] %s\n", time.Now().Format(time.StampNano), r.Method, string(response))
-
-					_, err2 := syncReplica(r, replicaURL1, newMemo)
-					if err2 != nil {
-						log.Printf("Failed to sync PATCH request to %s\n", replicaURL1)
-					}
+
+			node.MemosMu.Lock()
+			memo, found, err := node.MemoStore.Get(id)
+			if err != nil {
+				node.MemosMu.Unlock()
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if found {
+				if !node.IfMatch(r, memo) {
+					node.MemosMu.Unlock()
+					node.PreconditionFailed(w, r, memo)
+					return
+				}
+				var patch node.MemoPatch
+
+				// Update the memo with the new body if provided in the request
+				if newBody, ok := requestBody["body"]; ok {
+					patch.Body = &newBody
+				}
+
+				if newTitle, ok := requestBody["title"]; ok {
+					patch.Title = &newTitle
+				}
+				node.CRDTMerge(r, id, patch.Title, patch.Body)
+				memo, _, err = node.MemoStore.Patch(id, patch)
+				if err != nil {
+					node.MemosMu.Unlock()
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				// the log carries the whole patched memo, the replicas cannot tell an empty field from a missing one
+				newMemo = memo
+				entry := node.AppendLog(r, newMemo)
+				node.MemosMu.Unlock()
+
+				response, err := json.Marshal(memo)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				ok, results := node.ReplicateUpdate(r, entry)
+				if !ok {
+					node.ReplicationFailed(w, r, newMemo, results)
 					return
 				}
+				node.SetAckHeader(w, results)
+				node.SetConsistencyToken(w, entry.Seq)
+				node.SetETag(w, memo)
+
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusOK)
+				_, _ = w.Write(response)
+
+				fmt.Printf("[2023 %s] Primary SERVER [REPLY]          [METHOD: %s] %s\n", time.Now().Format(time.StampNano), r.Method, string(response))
+				return
 			}
 
+			node.MemosMu.Unlock()
 			http.Error(w, "Memo not found", http.StatusNotFound)
 			fmt.Printf("[2023 %s] Primary SERVER [UPATE REPLICA]  [METHOD: %s] No NEED TO UPDATE REPLICA\n", time.Now().Format(time.StampNano), r.Method)
 			return
@@ -426,7 +377,7 @@ func addMemo(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid endpoint", http.StatusBadRequest)
 
 	} else if r.Method == http.MethodPut {
-		logRequest(r, "Received PUT request")
+		node.LogRequest(r, "Received PUT request")
 
 		params := mux.Vars(r)
 		if idStr, ok := params["id"]; ok {
@@ -436,7 +387,7 @@ func addMemo(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			var newMemo Memo
+			var newMemo node.Memo
 			err = json.NewDecoder(r.Body).Decode(&newMemo)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusBadRequest)
@@ -444,33 +395,55 @@ func addMemo(w http.ResponseWriter, r *http.Request) {
 			}
 			newMemo.ID = id
 
-			memosMu.Lock()
-			defer memosMu.Unlock()
-
-			for i, memo := range memos {
-				if memo.ID == id {
-					memos[i] = newMemo
-
-					response, err := json.Marshal(memos[i])
-					if err != nil {
-						http.Error(w, err.Error(), http.StatusInternalServerError)
-						return
-					}
-
-					w.Header().Set("Content-Type", "application/json")
-					w.WriteHeader(http.StatusOK)
-					_, _ = w.Write(response)
+			node.MemosMu.Lock()
+			memo, found, err := node.MemoStore.Get(id)
+			if err != nil {
+				node.MemosMu.Unlock()
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if found {
+				if !node.IfMatch(r, memo) {
+					node.MemosMu.Unlock()
+					node.PreconditionFailed(w, r, memo)
+					return
+				}
+				node.CRDTMerge(r, id, &newMemo.Title, &newMemo.Body)
+				newMemo.Version = memo.Version + 1
+				err = node.MemoStore.Put(newMemo)
+				if err != nil {
+					node.MemosMu.Unlock()
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				memo = newMemo
+				entry := node.AppendLog(r, newMemo)
+				node.MemosMu.Unlock()
 
-					fmt.Printf("[2023 %s] Primary SERVER [REPLY]          [METHOD: %s] %s\n", time.Now().Format(time.StampNano), r.Method, string(response))
+				response, err := json.Marshal(memo)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
 
-					_, err2 := syncReplica(r, replicaURL1, newMemo)
-					if err2 != nil {
-						log.Printf("Failed to sync PUT request to %s\n", replicaURL1)
-					}
+				ok, results := node.ReplicateUpdate(r, entry)
+				if !ok {
+					node.ReplicationFailed(w, r, newMemo, results)
 					return
 				}
+				node.SetAckHeader(w, results)
+				node.SetConsistencyToken(w, entry.Seq)
+				node.SetETag(w, memo)
+
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusOK)
+				_, _ = w.Write(response)
+
+				fmt.Printf("[2023 %s] Primary SERVER [REPLY]          [METHOD: %s] %s\n", time.Now().Format(time.StampNano), r.Method, string(response))
+				return
 			}
 
+			node.MemosMu.Unlock()
 			http.Error(w, "Memo not found", http.StatusNotFound)
 			fmt.Printf("[2023 %s] Primary SERVER [UPATE REPLICA]  [METHOD: %s] No NEED TO UPDATE REPLICA\n", time.Now().Format(time.StampNano), r.Method)
 			return
@@ -488,28 +461,25 @@ func main() {
 		return
 	}
 
-	configFile := os.Args[1]
-	configData, err := ioutil.ReadFile(configFile)
-	if err != nil {
-		log.Fatalf("Error reading the config file: %s\n", err)
-	}
-
-	var config Configuration
-	err = json.Unmarshal(configData, &config)
-	if err != nil {
-		log.Fatalf("Error decoding the config JSON: %s\n", err)
-	}
+	node.LoadConfig(os.Args[1], 0)
 
-	fmt.Printf("Service Port: %d\n", config.ServicePort)
-	fmt.Printf("Sync Method: %s\n", config.Sync)
+	fmt.Printf("Service Port: %d\n", node.Config.ServicePort)
+	fmt.Printf("Sync Method: %s\n", node.Config.Sync)
+	fmt.Printf("Store: %s\n", node.StoreKind())
+	fmt.Printf("Ack Mode: %s\n", node.AckMode())
 	fmt.Println("Replicas:")
-	for _, replica := range config.Replicas {
+	for _, replica := range node.Config.Replicas {
 		fmt.Println(replica)
 	}
 
+	node.Recover()
+	node.Join(node.SelfAddr)
+	node.Start()
+
 	router := mux.NewRouter()
 	router.HandleFunc("/note", addMemo).Methods(http.MethodGet, http.MethodPost)
 	router.HandleFunc("/note/{id}", addMemo).Methods(http.MethodGet, http.MethodDelete, http.MethodPatch, http.MethodPut)
+	node.RegisterHandlers(router)
 
 	fmt.Println("Primary Server is running on port 8080...")
 	if err := http.ListenAndServe(":8080", router); err != nil {
@@ -517,3 +487,4 @@ func main() {
 	}
 }
 
+
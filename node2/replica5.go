@@ -1,3 +1,5 @@
+//go:build ignore
+
 /*
 	2023.12.01 ~ 2023.12.12
 	Jongki Park
@@ -1,3 +1,5 @@
+//go:build ignore
+
 /*
 	2023.12.01 ~ 2023.12.12
 	Jongki Park
@@ -10,9 +12,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"strconv"
-	"sync"
+	"strings"
 	"time"
 	"bytes"
 	"io"
@@ -20,65 +23,66 @@ import (
 	"os"
 	"path/filepath"
 	"github.com/gorilla/mux"
+	"Simple_DistributedSystem/node"
 )
 
-type Configuration struct {
-	ServicePort int		`json:"servicePort"`
-	Sync		string	`json:"sync"`
-	Replicas	[]string`json:"replicas"`
-}
-
-type Memo struct {
-	ID    int    `json:"id"`
-	Title string `json:"title"`
-	Body  string `json:"body"`
-}
-
-var (
-	memos   []Memo
-	memosMu sync.Mutex
-	idCount = 0
-)
-
-func logRequest(r *http.Request, args ...interface{}) {
-    message := fmt.Sprint(args...)
-    fmt.Printf("[2023 %s] Replica SERVER [REQUEST] [METHOD: %s] %s\n", time.Now().Format(time.StampNano), r.Method, message)
-}
-
-func getPrimaryURL() (string, error) {
-	configFile := os.Args[1]
-
-	configData, err := ioutil.ReadFile(configFile)
-	if err != nil {
-		return "", err
+func forwardMemo(w http.ResponseWriter, r *http.Request) {
+	if !node.ConsistencyLevel(w, r) {
+		return
 	}
-
-	var config Configuration
-	err = json.Unmarshal(configData, &config)
-	if err != nil {
-		return "", err
+	if node.Config.Sync == "quorum" {
+		node.QuorumRequest(w, r)
+		return
 	}
-
-	if len(config.Replicas) == 0 {
-		return "", fmt.Errorf("Invalid config.json file")
+	if node.Config.Sync == "multi-primary" {
+		node.MultiRequest(w, r)
+		return
+	}
+	if node.Config.Sync == "chain" && r.Method == http.MethodGet && node.ChainRead(w, r) {
+		return
 	}
 
-	replicaURL := "http://" + config.Replicas[0] + "/note"
+	if node.Config.Sync == "raft" && r.Method != http.MethodGet {
+		node.RaftWrite(w, r)
+		return
+	}
 
-	return replicaURL, nil
-}
+	if node.RequireLease(w, r) {
+		return
+	}
+	// after a failover this node may be the primary itself
+	if node.AmPrimary() && r.Method != http.MethodGet && node.Config.Sync != "local-write" {
+		done, answered := node.IdempotencyGuard(w, r)
+		if answered {
+			return
+		}
+		defer done()
+		if node.Config.Sync == "atomic" {
+			node.AtomicWrite(w, r)
+		} else {
+			primaryWrite(w, r)
+		}
+		return
+	}
 
-func forwardMemo(w http.ResponseWriter, r *http.Request) {
-	primaryURL, err := getPrimaryURL()
-    if err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
+	primaryURL, err := node.GetPrimaryURL()
+    if err != nil && r.Method != http.MethodGet {
+        http.Error(w, err.Error(), http.StatusServiceUnavailable)
         return
     }
 
     //fmt.Printf("Primary server URL: %s\n", primaryURL)
 
+	if node.Config.Sync == "local-write" && r.Method != http.MethodGet {
+		node.LocalWrite(w, r)
+		return
+	}
+
 	if r.Method == http.MethodGet {
-		logRequest(r, "Received GET request")
+		node.LogRequest(r, "Received GET request")
+		if node.RefuseIfNotReady(w, r) || node.AwaitToken(w, r) || node.BoundedRead(w, r) || node.ConsistentRead(w, r) {
+			return
+		}
 		var message string
 
 		params := mux.Vars(r)
@@ -89,35 +93,39 @@ func forwardMemo(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			memosMu.Lock()
-			defer memosMu.Unlock()
-
-			found := false
-			for _, memo := range memos {
-				if memo.ID == id {
-					response, err := json.Marshal(memo)
-					if err != nil {
-						http.Error(w, err.Error(), http.StatusInternalServerError)
-						return
-					}
-
-					w.Header().Set("Content-Type", "application/json")
-					w.WriteHeader(http.StatusOK)
-					_, _ = w.Write(response)
-
-					message = string(response)
-					found = true
-					break
-				}
+			node.MemosMu.Lock()
+			defer node.MemosMu.Unlock()
+
+			memo, found, err := node.MemoStore.Get(id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
 			}
+			if found {
+				response, err := json.Marshal(memo)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				node.SetETag(w, memo)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusOK)
+				_, _ = w.Write(response)
 
-			if !found {
+				message = string(response)
+			} else {
 				message = "No Data"
 			}
 		} else {
-			memosMu.Lock()
-			defer memosMu.Unlock()
+			node.MemosMu.Lock()
+			defer node.MemosMu.Unlock()
 
+			memos, err := node.MemoStore.List()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
 			if len(memos) == 0 {
 				message = "No Data"
 			} else {
@@ -159,7 +167,7 @@ func forwardMemo(w http.ResponseWriter, r *http.Request) {
 			req.Header[h] = val
 		}
 
-		client := http.Client{}
+		client := http.Client{Timeout: 10 * time.Second}
 		resp, err := client.Do(req)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadGateway)
@@ -197,7 +205,7 @@ func forwardMemo(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		primaryURL, err := getPrimaryURL()
+		primaryURL, err := node.GetPrimaryURL()
 		if err != nil {
 			http.Error(w, "Failed to get primary URL", http.StatusInternalServerError)
 			return
@@ -205,12 +213,15 @@ func forwardMemo(w http.ResponseWriter, r *http.Request) {
 
 		forwardURL := fmt.Sprintf("%s/%d", primaryURL, id)
 
-		client := http.Client{}
+		client := http.Client{Timeout: 10 * time.Second}
 		primaryReq, err := http.NewRequest(http.MethodDelete, forwardURL, nil)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		for h, val := range r.Header {
+			primaryReq.Header[h] = val
+		}
 
 		fmt.Printf("[2023 %s] Replica SERVER [FORWARD] [METHOD: %s] to [%s]\n", time.Now().Format(time.StampNano), r.Method, forwardURL)
 
@@ -259,7 +270,7 @@ func forwardMemo(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		primaryURL, err := getPrimaryURL()
+		primaryURL, err := node.GetPrimaryURL()
 		if err != nil {
 			http.Error(w, "Failed to get primary URL", http.StatusInternalServerError)
 			return
@@ -267,7 +278,7 @@ func forwardMemo(w http.ResponseWriter, r *http.Request) {
 
 		forwardURL := fmt.Sprintf("%s/%d", primaryURL, id)
 
-		client := http.Client{}
+		client := http.Client{Timeout: 10 * time.Second}
 
 		// Prepare the request body
 		newBody, bodyExist := requestBody["body"]
@@ -349,7 +360,7 @@ func forwardMemo(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		primaryURL, err := getPrimaryURL()
+		primaryURL, err := node.GetPrimaryURL()
 		if err != nil {
 			http.Error(w, "Failed to get primary URL", http.StatusInternalServerError)
 			return
@@ -357,7 +368,7 @@ func forwardMemo(w http.ResponseWriter, r *http.Request) {
 
 		forwardURL := fmt.Sprintf("%s/%d", primaryURL, id)
 
-		client := http.Client{}
+		client := http.Client{Timeout: 10 * time.Second}
 
 		// Prepare the request body
 		newBody, bodyExist := requestBody["body"]
@@ -423,36 +434,11 @@ func forwardMemo(w http.ResponseWriter, r *http.Request) {
 }
 
 func addMemo(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodPost {
-		var newMemo Memo
-		err := json.NewDecoder(r.Body).Decode(&newMemo)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-
-		memosMu.Lock()
-		defer memosMu.Unlock()
-
-		idCount++
-		newMemo.ID = idCount
-		memos = append(memos, newMemo)
-
-		logRequest(r, "Received Update Request from Primary server")
-
-		response, err := json.Marshal(newMemo)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	if r.Method == http.MethodGet {
+		node.LogRequest(r, "Received GET request")
+		if node.RefuseIfNotReady(w, r) {
 			return
 		}
-
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusCreated)
-		_, _ = w.Write(response)
-		fmt.Printf("[2023 %s] Replica SERVER [REPLY]   [METHOD: %s] Reply Update to Primary server\n", time.Now().Format(time.StampNano), r.Method)
-
-	} else if r.Method == http.MethodGet {
-		logRequest(r, "Received GET request")
 		var message string
 
 		params := mux.Vars(r)
@@ -463,35 +449,39 @@ func addMemo(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			memosMu.Lock()
-			defer memosMu.Unlock()
-
-			found := false
-			for _, memo := range memos {
-				if memo.ID == id {
-					response, err := json.Marshal(memo)
-					if err != nil {
-						http.Error(w, err.Error(), http.StatusInternalServerError)
-						return
-					}
-
-					w.Header().Set("Content-Type", "application/json")
-					w.WriteHeader(http.StatusOK)
-					_, _ = w.Write(response)
-
-					message = string(response)
-					found = true
-					break
-				}
+			node.MemosMu.Lock()
+			defer node.MemosMu.Unlock()
+
+			memo, found, err := node.MemoStore.Get(id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
 			}
+			if found {
+				response, err := json.Marshal(memo)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				node.SetETag(w, memo)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusOK)
+				_, _ = w.Write(response)
 
-			if !found {
+				message = string(response)
+			} else {
 				message = "No Data"
 			}
 		} else {
-			memosMu.Lock()
-			defer memosMu.Unlock()
+			node.MemosMu.Lock()
+			defer node.MemosMu.Unlock()
 
+			memos, err := node.MemoStore.List()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
 			if len(memos) == 0 {
 				message = "No Data"
 			} else {
@@ -511,140 +501,134 @@ func addMemo(w http.ResponseWriter, r *http.Request) {
 
 		fmt.Printf("[2023 %s] Replica SERVER [REPLY]   [METHOD: %s] %s\n", time.Now().Format(time.StampNano), r.Method, message)
 
-	} else if r.Method == http.MethodDelete {
-		logRequest(r, "Received Update Request from Primary server")
+	} else if r.Method == http.MethodPost || r.Method == http.MethodDelete || r.Method == http.MethodPatch || r.Method == http.MethodPut {
+		node.LogRequest(r, "Received Update Request from Primary server")
+		node.ApplyFromPrimary(w, r)
 
-		params := mux.Vars(r)
-		if idStr, ok := params["id"]; ok {
-			id, err := strconv.Atoi(idStr)
-			if err != nil {
-				http.Error(w, "Invalid ID", http.StatusBadRequest)
-				return
-			}
+	} else {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
 
-			memosMu.Lock()
-			defer memosMu.Unlock()
+// replicationStatus exposes the last sequence number applied on this replica
+func replicationStatus(w http.ResponseWriter, r *http.Request) {
+	node.MemosMu.Lock()
+	response, err := json.Marshal(map[string]interface{}{
+		"lastSeq": node.LastSeq,
+		"buffered":    len(node.PendingEntries),
+		"ready":       node.Ready,
+	})
+	node.MemosMu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-			for i, memo := range memos {
-				if memo.ID == id {
-					memos = append(memos[:i], memos[i+1:]...)
-					w.Header().Set("Content-Type", "application/json")
-					w.WriteHeader(http.StatusOK)
-					_, _ = w.Write([]byte(`{"msg": "OK"}`))
-					fmt.Printf("[2023 %s] Replica SERVER [REPLY]   [METHOD: %s] Reply Update to Primary server\n", time.Now().Format(time.StampNano), r.Method)
-					return
-				}
-			}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(response)
+}
 
-			http.Error(w, "Memo not found", http.StatusNotFound)
+// primaryWrite applies a client write while this node is the primary
+func primaryWrite(w http.ResponseWriter, r *http.Request) {
+	node.LogRequest(r, "Received ", r.Method, " request as primary")
+
+	var newMemo node.Memo
+	if r.Method != http.MethodPost {
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
 			return
 		}
+		newMemo.ID = id
+	}
 
-		http.Error(w, "Invalid endpoint", http.StatusBadRequest)
-
-	} else if r.Method == http.MethodPatch {
-		logRequest(r, "Received Update Request from Primary server")
-
-		params := mux.Vars(r)
-		if idStr, ok := params["id"]; ok {
-			id, err := strconv.Atoi(idStr)
-			if err != nil {
-				http.Error(w, "Invalid ID", http.StatusBadRequest)
-				return
-			}
-
-			var requestBody map[string]string
-			err = json.NewDecoder(r.Body).Decode(&requestBody)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-
-			memosMu.Lock()
-			defer memosMu.Unlock()
-
-			for i, memo := range memos {
-				if memo.ID == id {
-					// Update the memo with the new body if provided in the request
-					if newBody, ok := requestBody["body"]; ok {
-						memos[i].Body = newBody
-					}
-
-					if newTitle, ok := requestBody["title"]; ok {
-						memos[i].Title = newTitle
-					}
-
-					response, err := json.Marshal(memos[i])
-					if err != nil {
-						http.Error(w, err.Error(), http.StatusInternalServerError)
-						return
-					}
-
-					w.Header().Set("Content-Type", "application/json")
-					w.WriteHeader(http.StatusOK)
-					_, _ = w.Write(response)
-					fmt.Printf("[2023 %s] Replica SERVER [REPLY]   [METHOD: %s] Reply Update to Primary server\n", time.Now().Format(time.StampNano), r.Method)
-					return
-				}
-			}
-
-			http.Error(w, "Memo not found", http.StatusNotFound)
+	var requestBody map[string]string
+	if r.Method != http.MethodDelete {
+		err := json.NewDecoder(r.Body).Decode(&requestBody)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+	}
 
-		http.Error(w, "Invalid endpoint", http.StatusBadRequest)
-	} else if r.Method == http.MethodPut {
-		logRequest(r, "Received Update Request from Primary server")
-
-		params := mux.Vars(r)
-		if idStr, ok := params["id"]; ok {
-			id, err := strconv.Atoi(idStr)
-			if err != nil {
-				http.Error(w, "Invalid ID", http.StatusBadRequest)
-				return
-			}
-
-			var newMemo Memo
-			err = json.NewDecoder(r.Body).Decode(&newMemo)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-			newMemo.ID = id
-
-			memosMu.Lock()
-			defer memosMu.Unlock()
-
-			for i, memo := range memos {
-				if memo.ID == id {
-					memos[i] = newMemo
-
-					response, err := json.Marshal(memos[i])
-					if err != nil {
-						http.Error(w, err.Error(), http.StatusInternalServerError)
-						return
-					}
-
-					w.Header().Set("Content-Type", "application/json")
-					w.WriteHeader(http.StatusOK)
-					_, _ = w.Write(response)
-					fmt.Printf("[2023 %s] Replica SERVER [REPLY]   [METHOD: %s] Reply Update to Primary server\n", time.Now().Format(time.StampNano), r.Method)
-					return
-				}
-			}
-
+	node.MemosMu.Lock()
+	if r.Method == http.MethodPost {
+		node.IDCount++
+		newMemo.ID = node.IDCount
+		newMemo.Title = requestBody["title"]
+		newMemo.Body = requestBody["body"]
+	} else {
+		memo, ok := node.GetMemo(newMemo.ID)
+		if !ok {
+			node.MemosMu.Unlock()
 			http.Error(w, "Memo not found", http.StatusNotFound)
 			return
 		}
+		if !node.IfMatch(r, memo) {
+			node.MemosMu.Unlock()
+			node.PreconditionFailed(w, r, memo)
+			return
+		}
+		if r.Method == http.MethodPatch {
+			newMemo = memo
+			newMemo.Version = 0
+		}
+		if r.Method == http.MethodDelete {
+			newMemo.Version = memo.Version
+		}
+		var title, body *string
+		if newBody, ok := requestBody["body"]; ok {
+			body = &newBody
+		}
+		if newTitle, ok := requestBody["title"]; ok {
+			title = &newTitle
+		}
+		node.CRDTMerge(r, newMemo.ID, title, body)
+		if body != nil {
+			newMemo.Body = *body
+		}
+		if title != nil {
+			newMemo.Title = *title
+		}
+	}
+	entry := node.LogEntry{Method: r.Method, Memo: newMemo}
+	res := node.ApplyEntry(entry)
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		// nothing changed, there is nothing to log or replicate
+		node.MemosMu.Unlock()
+		http.Error(w, string(res.Response), res.StatusCode)
+		return
+	}
+	if memo, ok := node.GetMemo(newMemo.ID); ok {
+		newMemo = memo
+		node.SetETag(w, newMemo)
+	}
+	entry = node.AppendLog(r, newMemo)
+	node.MemosMu.Unlock()
 
-		http.Error(w, "Invalid endpoint", http.StatusBadRequest)
-	} else {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	// the same ack mode, queues and chain confirmation as on the original primary
+	ok, results := node.ReplicateUpdate(r, entry)
+	if !ok {
+		node.ReplicationFailed(w, r, newMemo, results)
+		return
 	}
+	node.SetAckHeader(w, results)
+	node.SetConsistencyToken(w, entry.Seq)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(res.StatusCode)
+	_, _ = w.Write(res.Response)
+	fmt.Printf("[2023 %s] Replica SERVER [REPLY]   [METHOD: %s] %s (as primary, seq %d)\n", time.Now().Format(time.StampNano), r.Method, string(res.Response), entry.Seq)
 }
 
 func requestFilter(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/note") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		fromPrimary := r.Header.Get("From-Primary")
 		if fromPrimary == "true" {
 			//fmt.Println("This Request is from Primary Server")
@@ -657,37 +641,50 @@ func requestFilter(next http.Handler) http.Handler {
 }
 
 func main() {
-	if len(os.Args) != 2 {
-		fmt.Printf("Usage : go run %s config.json\n", filepath.Base(os.Args[0]))
+	if len(os.Args) != 2 && len(os.Args) != 3 {
+		fmt.Printf("Usage : go run %s config.json [replica index]\n", filepath.Base(os.Args[0]))
 		return
 	}
 
-	configFile := os.Args[1]
-	configData, err := ioutil.ReadFile(configFile)
-	if err != nil {
-		log.Fatalf("Error reading the config file: %s\n", err)
-	}
-
-	var config Configuration
-	err = json.Unmarshal(configData, &config)
-	if err != nil {
-		log.Fatalf("Error decoding the config JSON: %s\n", err)
+	// Replicas[1] is used by default, a third or fourth node is started with its index in config.json
+	index := 1
+	if len(os.Args) == 3 {
+		var err error
+		index, err = strconv.Atoi(os.Args[2])
+		if err != nil || index < 1 {
+			log.Fatalf("Invalid replica index: %s\n", os.Args[2])
+		}
 	}
+	node.Role = "Replica"
+	node.LoadConfig(os.Args[1], index)
 
-	fmt.Printf("Service Port: %d\n", config.ServicePort)
-	fmt.Printf("Sync Method: %s\n", config.Sync)
+	fmt.Printf("Service Port: %d\n", node.Config.ServicePort)
+	fmt.Printf("Sync Method: %s\n", node.Config.Sync)
+	fmt.Printf("Store: %s\n", node.StoreKind())
 	fmt.Println("Replicas:")
-	for _, replica := range config.Replicas {
+	for _, replica := range node.Config.Replicas {
 		fmt.Println(replica)
 	}
 
+	node.Recover()
+	node.Join(node.Config.Replicas[0])
+	node.Start()
+
 	router := mux.NewRouter()
 	router.Use(requestFilter)
 	router.HandleFunc("/note", addMemo).Methods(http.MethodGet, http.MethodPost)
 	router.HandleFunc("/note/{id}", addMemo).Methods(http.MethodGet, http.MethodDelete, http.MethodPatch, http.MethodPut)
+	router.HandleFunc("/replication/status", replicationStatus).Methods(http.MethodGet)
+	node.RegisterHandlers(router)
+
+	_, port, err := net.SplitHostPort(node.SelfAddr)
+	if err != nil {
+		log.Fatalf("Invalid replica address %s: %s\n", node.SelfAddr, err)
+	}
+	listenAddr := ":" + port
 
-	fmt.Println("Replica Server is running on port 8081...")
-	if err := http.ListenAndServe(":8081", router); err != nil {
+	fmt.Printf("Replica Server is running on port %s...\n", listenAddr[1:])
+	if err := http.ListenAndServe(listenAddr, router); err != nil {
 		log.Fatal(err)
 	}
 }